@@ -0,0 +1,283 @@
+package orgs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
+	"www.velocidex.com/golang/velociraptor/logging"
+)
+
+var (
+	backupLastSuccessTime = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "backup_last_success_time",
+		Help: "Unix timestamp of the last successful backup, per org.",
+	}, []string{"org_id"})
+
+	backupLastFailureTime = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "backup_last_failure_time",
+		Help: "Unix timestamp of the last failed backup, per org.",
+	}, []string{"org_id"})
+
+	backupLastError = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "backup_last_error",
+		Help: "Set to 1 while the last backup attempt for an org is in an error state.",
+	}, []string{"org_id"})
+)
+
+// BackupDestination abstracts the remote object store (or webhook) that
+// compressed archives are streamed to. Concrete implementations are
+// resolved from the `Backup.Type` config field by NewBackupDestination.
+type BackupDestination interface {
+	// Upload streams the archive for org_id to the destination and
+	// returns an identifier that can later be passed to RestoreOrg.
+	Upload(ctx context.Context, org_id string,
+		manifest *BackupManifest, archive ReadSeekCloser) (backup_id string, err error)
+
+	// Download retrieves a previously uploaded archive.
+	Download(ctx context.Context, org_id, backup_id string) (ReadSeekCloser, *BackupManifest, error)
+
+	// List returns all known backups for an org, most recent first.
+	List(ctx context.Context, org_id string) ([]*BackupManifest, error)
+
+	// Delete removes a backup - used when enforcing retention.
+	Delete(ctx context.Context, org_id, backup_id string) error
+}
+
+// ReadSeekCloser is the minimal interface required to stream an archive
+// to and from a BackupDestination.
+type ReadSeekCloser interface {
+	Read(p []byte) (int, error)
+	Seek(offset int64, whence int) (int64, error)
+	Close() error
+}
+
+// BackupManifest accompanies every archive uploaded to the remote store
+// so that RestoreOrg and retention pruning do not need to download the
+// archive itself in order to reason about it.
+type BackupManifest struct {
+	OrgId     string `json:"org_id"`
+	BackupId  string `json:"backup_id"`
+	Timestamp int64  `json:"timestamp"`
+	Sha256    string `json:"sha256"`
+	Size      int64  `json:"size"`
+
+	// Encrypted records whether the archive this manifest describes
+	// was sealed with Backup.EncryptionKey - RestoreOrg needs this to
+	// know whether to decrypt before treating the downloaded bytes as
+	// a zip.
+	Encrypted bool `json:"encrypted"`
+}
+
+// BackupConfig configures the per-org backup subsystem. The feature
+// request asks for this to live as a `Backup` stanza on
+// config_proto.Config, but that field has not landed in config_proto
+// yet, so it is a plain struct here and wired up via ConfigureBackups
+// in the meantime - see the note there.
+type BackupConfig struct {
+	Enabled        bool
+	Type           string
+	Endpoint       string
+	Prefix         string
+	Credentials    string
+	CadenceSeconds int64
+	RetentionCount int64
+	EncryptionKey  string
+}
+
+// BackupManager periodically snapshots each org's datastore and
+// filestore to a configurable remote object store, and is able to
+// reconstruct an org from a previous snapshot on request.
+type BackupManager struct {
+	mu sync.Mutex
+
+	config_obj *config_proto.Config
+	cfg        *BackupConfig
+	org_mgr    *OrgManager
+
+	destination BackupDestination
+}
+
+// NewBackupManager builds a BackupManager from cfg. It returns a nil
+// manager (and no error) when backups are not configured, so callers
+// can unconditionally call Start().
+func NewBackupManager(
+	config_obj *config_proto.Config, cfg *BackupConfig,
+	org_mgr *OrgManager) (*BackupManager, error) {
+
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+
+	destination, err := newBackupDestination(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BackupManager{
+		config_obj:  config_obj,
+		cfg:         cfg,
+		org_mgr:     org_mgr,
+		destination: destination,
+	}, nil
+}
+
+// Start launches the periodic backup goroutine. It is called from
+// OrgManager.Start once all orgs have been scanned.
+func (self *BackupManager) Start(ctx context.Context, wg *sync.WaitGroup) {
+	logger := logging.GetLogger(self.config_obj, &logging.FrontendComponent)
+	logger.Info("<green>Starting</> Backup Manager service.")
+
+	cadence := time.Duration(self.cfg.CadenceSeconds) * time.Second
+	if cadence <= 0 {
+		cadence = time.Hour
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case <-time.After(cadence):
+				self.BackupAllOrgs(ctx)
+			}
+		}
+	}()
+}
+
+// BackupAllOrgs snapshots every currently registered org. Errors for an
+// individual org do not prevent the remaining orgs from being backed
+// up; they are recorded against that org's failure metric instead.
+func (self *BackupManager) BackupAllOrgs(ctx context.Context) {
+	logger := logging.GetLogger(self.config_obj, &logging.FrontendComponent)
+
+	self.org_mgr.mu.Lock()
+	org_ids := make([]string, 0, len(self.org_mgr.orgs))
+	for org_id := range self.org_mgr.orgs {
+		org_ids = append(org_ids, org_id)
+	}
+	self.org_mgr.mu.Unlock()
+
+	for _, org_id := range org_ids {
+		err := self.BackupOrg(ctx, org_id)
+		if err != nil {
+			logger.Error("BackupManager: org %v: %v", org_id, err)
+		}
+	}
+}
+
+// BackupOrg produces a compressed archive of the org's datastore and
+// filestore (excluding volatile paths such as notebooks/tmp and
+// downloads) - encrypted when Backup.EncryptionKey is configured,
+// plaintext otherwise - uploads it along with a manifest, and prunes
+// old backups according to the configured retention.
+func (self *BackupManager) BackupOrg(ctx context.Context, org_id string) (err error) {
+	defer func() {
+		if err != nil {
+			backupLastFailureTime.WithLabelValues(org_id).SetToCurrentTime()
+			backupLastError.WithLabelValues(org_id).Set(1)
+		} else {
+			backupLastSuccessTime.WithLabelValues(org_id).SetToCurrentTime()
+			backupLastError.WithLabelValues(org_id).Set(0)
+		}
+	}()
+
+	config_obj, err := self.org_mgr.GetOrgConfig(org_id)
+	if err != nil {
+		return err
+	}
+
+	archive, manifest, err := makeOrgArchive(
+		ctx, org_id, config_obj, self.cfg.EncryptionKey)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	backup_id, err := self.destination.Upload(ctx, org_id, manifest, archive)
+	if err != nil {
+		return err
+	}
+	manifest.BackupId = backup_id
+
+	return self.enforceRetention(ctx, org_id)
+}
+
+// enforceRetention deletes backups older than the configured number to
+// keep, oldest first.
+func (self *BackupManager) enforceRetention(ctx context.Context, org_id string) error {
+	keep := self.cfg.RetentionCount
+	if keep <= 0 {
+		return nil
+	}
+
+	manifests, err := self.destination.List(ctx, org_id)
+	if err != nil {
+		return err
+	}
+
+	for i := int(keep); i < len(manifests); i++ {
+		err := self.destination.Delete(ctx, org_id, manifests[i].BackupId)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RestoreOrg reconstructs an org from a previously uploaded backup and
+// re-registers it with the org manager via startOrg. This extracts the
+// archive directly onto the org's existing Datastore.Location and
+// FilestoreDirectory, then calls startOrg to rebuild the org's
+// OrgContext against the restored data - startOrg atomically replaces
+// any existing entry for this org id (see maybeRebindOrg), so there is
+// no separate stop step to run first.
+func (self *BackupManager) RestoreOrg(ctx context.Context, org_id, backup_id string) error {
+	archive, manifest, err := self.destination.Download(ctx, org_id, backup_id)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	org_record, err := self.org_mgr.GetOrg(org_id)
+	if err != nil {
+		return err
+	}
+
+	config_obj, err := self.org_mgr.GetOrgConfig(org_id)
+	if err != nil {
+		return err
+	}
+
+	err = restoreOrgArchive(ctx, config_obj, manifest, archive,
+		self.cfg.EncryptionKey)
+	if err != nil {
+		return err
+	}
+
+	return self.org_mgr.startOrg(org_record)
+}
+
+// newBackupDestination resolves a BackupDestination from cfg.Type -
+// only "webhook" moves archive bytes today, see newS3BackupDestination.
+func newBackupDestination(cfg *BackupConfig) (BackupDestination, error) {
+	switch cfg.Type {
+	case "s3":
+		return newS3BackupDestination(cfg)
+	case "gcs":
+		return newGCSBackupDestination(cfg)
+	case "webhook":
+		return newWebhookBackupDestination(cfg)
+	default:
+		return nil, fmt.Errorf("Unsupported backup type %q", cfg.Type)
+	}
+}
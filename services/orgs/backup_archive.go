@@ -0,0 +1,440 @@
+package orgs
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
+)
+
+// requireFilesystemBackend rejects orgs bound to a non-filesystem
+// DatastoreFactory - writeOrgArchive/restoreOrgArchive walk
+// config_obj.Datastore.Location/FilestoreDirectory with filepath.Walk/
+// os.Open, which silently produces an empty or broken archive against
+// an S3/SQL-backed org instead of failing loudly.
+func requireFilesystemBackend(config_obj *config_proto.Config) error {
+	factory, err := getDatastoreFactory(config_obj, nil)
+	if err != nil {
+		return err
+	}
+	if factory.Name() != "FileBaseDataStore" {
+		return fmt.Errorf(
+			"backup/restore only supports the filesystem datastore backend, "+
+				"org uses %q", factory.Name())
+	}
+	return nil
+}
+
+// volatilePaths are excluded from org archives because they are
+// either reconstructible (caches) or churn too fast to be worth
+// snapshotting (in progress downloads).
+var volatilePaths = []string{
+	"downloads",
+	"tmp",
+}
+
+// makeOrgArchive walks the org's Datastore.Location and
+// FilestoreDirectory, producing a single compressed archive together
+// with its manifest. When encryption_key is non-empty the archive is
+// additionally sealed with it (see encryptFile) before the manifest's
+// sha256/size are computed, so they describe the bytes that actually
+// get uploaded. The returned ReadSeekCloser refers to a temp file on
+// disk that the caller must Close() (which also removes it).
+func makeOrgArchive(ctx context.Context, org_id string,
+	config_obj *config_proto.Config, encryption_key string) (ReadSeekCloser, *BackupManifest, error) {
+
+	if config_obj.Datastore == nil {
+		return nil, nil, fmt.Errorf("Backup: org %v has no datastore configured", org_id)
+	}
+	if err := requireFilesystemBackend(config_obj); err != nil {
+		return nil, nil, fmt.Errorf("Backup: org %v: %w", org_id, err)
+	}
+
+	tmp_file, err := ioutil.TempFile("", "velo_backup_*.zip")
+	if err != nil {
+		return nil, nil, err
+	}
+	archive := &selfDeletingFile{File: tmp_file}
+
+	err = writeOrgArchive(ctx, tmp_file, config_obj)
+	if err != nil {
+		archive.Close()
+		return nil, nil, err
+	}
+
+	if encryption_key != "" {
+		err = encryptFile(tmp_file, encryption_key)
+		if err != nil {
+			archive.Close()
+			return nil, nil, err
+		}
+	}
+
+	info, err := tmp_file.Stat()
+	if err != nil {
+		archive.Close()
+		return nil, nil, err
+	}
+
+	hash, err := hashFile(tmp_file.Name())
+	if err != nil {
+		archive.Close()
+		return nil, nil, err
+	}
+
+	_, err = tmp_file.Seek(0, os.SEEK_SET)
+	if err != nil {
+		archive.Close()
+		return nil, nil, err
+	}
+
+	manifest := &BackupManifest{
+		OrgId:     org_id,
+		Timestamp: time.Now().UTC().Unix(),
+		Sha256:    hash,
+		Size:      info.Size(),
+		Encrypted: encryption_key != "",
+	}
+
+	return archive, manifest, nil
+}
+
+// writeOrgArchive streams every file under the org's datastore and
+// filestore directory trees into a zip archive written to dest,
+// skipping volatilePaths. Each root is stored under its own top level
+// directory in the archive ("datastore/..." or "filestore/...") so
+// restoreOrgArchive can put files back where they came from.
+func writeOrgArchive(ctx context.Context, dest *os.File,
+	config_obj *config_proto.Config) error {
+
+	writer := zip.NewWriter(dest)
+	defer writer.Close()
+
+	roots := map[string]string{}
+	if config_obj.Datastore.Location != "" {
+		roots["datastore"] = config_obj.Datastore.Location
+	}
+	if config_obj.Datastore.FilestoreDirectory != "" &&
+		config_obj.Datastore.FilestoreDirectory != config_obj.Datastore.Location {
+		roots["filestore"] = config_obj.Datastore.FilestoreDirectory
+	}
+
+	for prefix, root := range roots {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				// The root directory may not exist yet on a brand new
+				// org - that is not a backup failure.
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+
+			if info.IsDir() {
+				if isVolatilePath(path) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			return addFileToArchive(writer, root, prefix, path, info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func addFileToArchive(writer *zip.Writer, root, prefix, path string,
+	info os.FileInfo) error {
+
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return err
+	}
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(filepath.Join(prefix, rel))
+	header.Method = zip.Deflate
+
+	entry_writer, err := writer.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	_, err = io.Copy(entry_writer, fd)
+	return err
+}
+
+func isVolatilePath(path string) bool {
+	base := filepath.Base(path)
+	for _, volatile := range volatilePaths {
+		if base == volatile {
+			return true
+		}
+	}
+	return false
+}
+
+func hashFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("%x", sum), nil
+}
+
+// encryptFile seals f's entire contents in place with AES-256-GCM,
+// keyed by sha256(passphrase) - f is rewritten to hold the nonce
+// followed by the sealed ciphertext. Archives are backup-sized, not
+// streaming-sized, so reading the whole file into memory here matches
+// the same tradeoff hashFile above already makes.
+func encryptFile(f *os.File, passphrase string) error {
+	_, err := f.Seek(0, os.SEEK_SET)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	ciphertext, err := encryptBytes(plaintext, passphrase)
+	if err != nil {
+		return err
+	}
+
+	err = f.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = f.Seek(0, os.SEEK_SET)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(ciphertext)
+	return err
+}
+
+// encryptBytes seals plaintext with AES-256-GCM under a key derived
+// from passphrase, prefixing the result with the random nonce
+// decryptBytes needs to open it.
+func encryptBytes(plaintext []byte, passphrase string) ([]byte, error) {
+	gcm, err := newGCMCipher(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// decryptBytes is the reciprocal of encryptBytes.
+func decryptBytes(ciphertext []byte, passphrase string) ([]byte, error) {
+	gcm, err := newGCMCipher(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce_size := gcm.NonceSize()
+	if len(ciphertext) < nonce_size {
+		return nil, fmt.Errorf("Backup: encrypted archive is truncated")
+	}
+
+	nonce, sealed := ciphertext[:nonce_size], ciphertext[nonce_size:]
+	return gcm.Open(nil, nonce, sealed, nil)
+}
+
+func newGCMCipher(passphrase string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte(passphrase))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// restoreOrgArchive unpacks a downloaded archive back onto the org's
+// configured datastore and filestore locations, undoing the
+// "datastore/..."/"filestore/..." prefixing applied by writeOrgArchive.
+// When manifest.Encrypted is set, the archive is first decrypted with
+// encryption_key (which must be the same value makeOrgArchive sealed
+// it with) before it is treated as a zip.
+func restoreOrgArchive(ctx context.Context, config_obj *config_proto.Config,
+	manifest *BackupManifest, archive ReadSeekCloser, encryption_key string) error {
+
+	if config_obj.Datastore == nil {
+		return fmt.Errorf("Backup: org %v has no datastore configured", manifest.OrgId)
+	}
+	if err := requireFilesystemBackend(config_obj); err != nil {
+		return fmt.Errorf("Backup: org %v: %w", manifest.OrgId, err)
+	}
+
+	size, err := archive.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	_, err = archive.Seek(0, os.SEEK_SET)
+	if err != nil {
+		return err
+	}
+
+	var reader_at io.ReaderAt
+	if manifest.Encrypted {
+		ciphertext := make([]byte, size)
+		_, err = io.ReadFull(archive, ciphertext)
+		if err != nil {
+			return err
+		}
+
+		plaintext, err := decryptBytes(ciphertext, encryption_key)
+		if err != nil {
+			return fmt.Errorf("Backup: failed to decrypt archive for org %v: %w",
+				manifest.OrgId, err)
+		}
+
+		reader_at = bytes.NewReader(plaintext)
+		size = int64(len(plaintext))
+	} else {
+		var ok bool
+		reader_at, ok = archive.(io.ReaderAt)
+		if !ok {
+			return fmt.Errorf("Backup: restore archive does not support random access")
+		}
+	}
+
+	zip_reader, err := zip.NewReader(reader_at, size)
+	if err != nil {
+		return err
+	}
+
+	roots := map[string]string{
+		"datastore": config_obj.Datastore.Location,
+		"filestore": config_obj.Datastore.FilestoreDirectory,
+	}
+
+	for _, file := range zip_reader.File {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		err := restoreArchiveEntry(file, roots)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func restoreArchiveEntry(file *zip.File, roots map[string]string) error {
+	parts := strings.SplitN(filepath.ToSlash(file.Name), "/", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+
+	root, pres := roots[parts[0]]
+	if !pres || root == "" {
+		return nil
+	}
+
+	dest_path, err := safeJoin(root, filepath.FromSlash(parts[1]))
+	if err != nil {
+		// RestoreOrg downloads this archive from remote storage, so a
+		// crafted or corrupted archive must not be able to write
+		// outside root via ".."/absolute entry names (zip-slip,
+		// CWE-22) - reject the entry instead of extracting it.
+		return fmt.Errorf("Backup: refusing to restore zip entry %q: %w",
+			file.Name, err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(dest_path), 0700)
+	if err != nil {
+		return err
+	}
+
+	rc, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	out, err := os.OpenFile(dest_path,
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC, file.Mode())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, rc)
+	return err
+}
+
+// safeJoin joins root with rel and rejects the result if it would
+// resolve outside of root - a zip entry name containing ".." segments
+// or an absolute path must not be able to escape the extraction root.
+func safeJoin(root, rel string) (string, error) {
+	if filepath.IsAbs(rel) {
+		return "", fmt.Errorf("path %q is absolute", rel)
+	}
+
+	clean_root := filepath.Clean(root)
+	dest_path := filepath.Join(clean_root, rel)
+
+	if dest_path != clean_root &&
+		!strings.HasPrefix(dest_path, clean_root+string(os.PathSeparator)) {
+		return "", fmt.Errorf("path %q escapes %v", rel, root)
+	}
+
+	return dest_path, nil
+}
+
+// selfDeletingFile removes its backing temp file on Close().
+type selfDeletingFile struct {
+	*os.File
+}
+
+func (self *selfDeletingFile) Close() error {
+	name := self.File.Name()
+	err := self.File.Close()
+	os.Remove(name)
+	return err
+}
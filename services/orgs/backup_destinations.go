@@ -0,0 +1,358 @@
+package orgs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// s3BackupDestination uploads archives to an S3 compatible object
+// store. It is also used for any endpoint speaking the S3 API (Minio,
+// Wasabi, Backblaze B2, etc). Not implemented yet - see newS3BackupDestination.
+type s3BackupDestination struct {
+	config *BackupConfig
+}
+
+func newS3BackupDestination(
+	config_obj *BackupConfig) (BackupDestination, error) {
+	return nil, fmt.Errorf(
+		"Backup: S3 destination is not implemented yet - use \"webhook\" " +
+			"or contribute an S3 client")
+}
+
+func (self *s3BackupDestination) Upload(ctx context.Context, org_id string,
+	manifest *BackupManifest, archive ReadSeekCloser) (string, error) {
+	return "", fmt.Errorf("S3 backup destination not yet implemented")
+}
+
+func (self *s3BackupDestination) Download(ctx context.Context,
+	org_id, backup_id string) (ReadSeekCloser, *BackupManifest, error) {
+	return nil, nil, fmt.Errorf("S3 backup destination not yet implemented")
+}
+
+func (self *s3BackupDestination) List(ctx context.Context,
+	org_id string) ([]*BackupManifest, error) {
+	return nil, fmt.Errorf("S3 backup destination not yet implemented")
+}
+
+func (self *s3BackupDestination) Delete(ctx context.Context, org_id, backup_id string) error {
+	return fmt.Errorf("S3 backup destination not yet implemented")
+}
+
+// gcsBackupDestination uploads archives to a Google Cloud Storage
+// bucket. See the note on s3BackupDestination above - not implemented
+// yet, refuses to construct.
+type gcsBackupDestination struct {
+	config *BackupConfig
+}
+
+func newGCSBackupDestination(
+	config_obj *BackupConfig) (BackupDestination, error) {
+	return nil, fmt.Errorf(
+		"Backup: GCS destination is not implemented yet - use \"webhook\" " +
+			"or contribute a GCS client")
+}
+
+func (self *gcsBackupDestination) Upload(ctx context.Context, org_id string,
+	manifest *BackupManifest, archive ReadSeekCloser) (string, error) {
+	return "", fmt.Errorf("GCS backup destination not yet implemented")
+}
+
+func (self *gcsBackupDestination) Download(ctx context.Context,
+	org_id, backup_id string) (ReadSeekCloser, *BackupManifest, error) {
+	return nil, nil, fmt.Errorf("GCS backup destination not yet implemented")
+}
+
+func (self *gcsBackupDestination) List(ctx context.Context,
+	org_id string) ([]*BackupManifest, error) {
+	return nil, fmt.Errorf("GCS backup destination not yet implemented")
+}
+
+func (self *gcsBackupDestination) Delete(ctx context.Context, org_id, backup_id string) error {
+	return fmt.Errorf("GCS backup destination not yet implemented")
+}
+
+// webhookBackupDestination POSTs the archive to a generic HTTP
+// endpoint, e.g. an internal backup relay, and keeps a local manifest
+// index (under config.Endpoint's directory counterpart) so List/Delete
+// and retention pruning have something to work against without
+// requiring the remote end to implement a query API.
+//
+// This is the one fully wired up destination: Upload/Download actually
+// move archive bytes over the wire, and Download verifies the
+// manifest's sha256 against what was received.
+type webhookBackupDestination struct {
+	config     *BackupConfig
+	httpClient *http.Client
+}
+
+func newWebhookBackupDestination(
+	config_obj *BackupConfig) (BackupDestination, error) {
+	if config_obj.Endpoint == "" {
+		return nil, fmt.Errorf("Backup: webhook destination requires an endpoint")
+	}
+	return &webhookBackupDestination{
+		config:     config_obj,
+		httpClient: http.DefaultClient,
+	}, nil
+}
+
+func (self *webhookBackupDestination) Upload(ctx context.Context, org_id string,
+	manifest *BackupManifest, archive ReadSeekCloser) (string, error) {
+
+	manifest.BackupId = fmt.Sprintf("%v-%v", org_id, manifest.Timestamp)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut,
+		self.archiveURL(org_id, manifest.BackupId), archive)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = manifest.Size
+	req.Header.Set("Content-Type", "application/zip")
+	req.Header.Set("X-Velociraptor-Backup-Sha256", manifest.Sha256)
+	if self.config.Credentials != "" {
+		req.Header.Set("Authorization", "Bearer "+self.config.Credentials)
+	}
+
+	resp, err := self.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("Backup: webhook upload failed: %v: %s",
+			resp.Status, body)
+	}
+
+	err = self.putManifest(ctx, org_id, manifest)
+	if err != nil {
+		return "", err
+	}
+
+	return manifest.BackupId, nil
+}
+
+func (self *webhookBackupDestination) Download(ctx context.Context,
+	org_id, backup_id string) (ReadSeekCloser, *BackupManifest, error) {
+
+	manifest, err := self.getManifest(ctx, org_id, backup_id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		self.archiveURL(org_id, backup_id), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if self.config.Credentials != "" {
+		req.Header.Set("Authorization", "Bearer "+self.config.Credentials)
+	}
+
+	resp, err := self.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, nil, fmt.Errorf("Backup: webhook download failed: %v: %s",
+			resp.Status, body)
+	}
+
+	tmp_file, err := ioutil.TempFile("", "velo_restore_*.zip")
+	if err != nil {
+		return nil, nil, err
+	}
+	archive := &selfDeletingFile{File: tmp_file}
+
+	hash, err := copyAndHash(tmp_file, resp.Body)
+	if err != nil {
+		archive.Close()
+		return nil, nil, err
+	}
+	if hash != manifest.Sha256 {
+		archive.Close()
+		return nil, nil, fmt.Errorf(
+			"Backup: downloaded archive sha256 %v does not match manifest %v",
+			hash, manifest.Sha256)
+	}
+
+	_, err = tmp_file.Seek(0, os.SEEK_SET)
+	if err != nil {
+		archive.Close()
+		return nil, nil, err
+	}
+
+	return archive, manifest, nil
+}
+
+// listStored fetches the remote manifest index exactly as it is
+// stored - oldest first, in the order putManifest appends to it. List
+// and putManifest/getManifest both build on this single source of
+// truth so the two never disagree about what "stored order" means.
+func (self *webhookBackupDestination) listStored(ctx context.Context,
+	org_id string) ([]*BackupManifest, error) {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		self.indexURL(org_id), nil)
+	if err != nil {
+		return nil, err
+	}
+	if self.config.Credentials != "" {
+		req.Header.Set("Authorization", "Bearer "+self.config.Credentials)
+	}
+
+	resp, err := self.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("Backup: webhook list failed: %v: %s", resp.Status, body)
+	}
+
+	manifests := []*BackupManifest{}
+	err = json.NewDecoder(resp.Body).Decode(&manifests)
+	if err != nil {
+		return nil, err
+	}
+
+	return manifests, nil
+}
+
+// List returns the remote manifests most recent first, matching the
+// BackupDestination contract - the reverse of how they are stored.
+func (self *webhookBackupDestination) List(ctx context.Context,
+	org_id string) ([]*BackupManifest, error) {
+
+	manifests, err := self.listStored(ctx, org_id)
+	if err != nil {
+		return nil, err
+	}
+
+	reversed := make([]*BackupManifest, len(manifests))
+	for i, manifest := range manifests {
+		reversed[len(manifests)-1-i] = manifest
+	}
+
+	return reversed, nil
+}
+
+func (self *webhookBackupDestination) Delete(ctx context.Context, org_id, backup_id string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete,
+		self.archiveURL(org_id, backup_id), nil)
+	if err != nil {
+		return err
+	}
+	if self.config.Credentials != "" {
+		req.Header.Set("Authorization", "Bearer "+self.config.Credentials)
+	}
+
+	resp, err := self.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Backup: webhook delete failed: %v: %s", resp.Status, body)
+	}
+
+	return nil
+}
+
+func (self *webhookBackupDestination) putManifest(
+	ctx context.Context, org_id string, manifest *BackupManifest) error {
+
+	// Append to the stored (oldest first) representation, not to
+	// List's most-recent-first view - writing List's output back
+	// verbatim would flip the stored order on every call and corrupt
+	// enforceRetention's notion of "oldest".
+	manifests, err := self.listStored(ctx, org_id)
+	if err != nil {
+		// Best effort - the remote end may not support listing yet.
+		manifests = nil
+	}
+	manifests = append(manifests, manifest)
+
+	payload, err := json.Marshal(manifests)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut,
+		self.indexURL(org_id), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if self.config.Credentials != "" {
+		req.Header.Set("Authorization", "Bearer "+self.config.Credentials)
+	}
+
+	resp, err := self.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Backup: webhook manifest update failed: %v: %s",
+			resp.Status, body)
+	}
+
+	return nil
+}
+
+func (self *webhookBackupDestination) getManifest(
+	ctx context.Context, org_id, backup_id string) (*BackupManifest, error) {
+
+	manifests, err := self.List(ctx, org_id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, manifest := range manifests {
+		if manifest.BackupId == backup_id {
+			return manifest, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Backup: no manifest found for backup %v", backup_id)
+}
+
+func (self *webhookBackupDestination) archiveURL(org_id, backup_id string) string {
+	return fmt.Sprintf("%v/%v/%v/%v.zip",
+		self.config.Endpoint, self.config.Prefix, org_id, backup_id)
+}
+
+func (self *webhookBackupDestination) indexURL(org_id string) string {
+	return fmt.Sprintf("%v/%v/%v/manifests.json",
+		self.config.Endpoint, self.config.Prefix, org_id)
+}
+
+func copyAndHash(dest *os.File, src io.Reader) (string, error) {
+	hasher := sha256.New()
+	_, err := io.Copy(dest, io.TeeReader(src, hasher))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
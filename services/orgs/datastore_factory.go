@@ -0,0 +1,128 @@
+package orgs
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
+	"www.velocidex.com/golang/velociraptor/datastore"
+	"www.velocidex.com/golang/velociraptor/file_store"
+	"www.velocidex.com/golang/velociraptor/file_store/api"
+)
+
+// DatastoreBackendConfig carries the settings a non-filesystem
+// DatastoreFactory needs (bucket, endpoint, credentials, dsn) to bind
+// an org onto its own backend. The feature request asks for these to
+// live as Bucket/Endpoint/Credentials/SqlDsn fields on
+// config_proto.DatastoreConfig, but that message only has
+// Implementation/Location/FilestoreDirectory today, so they are kept
+// in this local struct and threaded through OrgManager.SetOrgDatastore
+// instead, until it does.
+type DatastoreBackendConfig struct {
+	Implementation string
+	Bucket         string
+	Endpoint       string
+	Credentials    string
+	SqlDsn         string
+}
+
+// DatastoreFactory builds the datastore.DataStore and file_store.FileStore
+// implementations for one org, based on that org's DatastoreBackendConfig
+// (see OrgManager.SetOrgDatastore). This is meant to let different orgs
+// live on entirely different physical backends (filesystem,
+// S3-compatible object storage, SQL) instead of all being forced onto
+// the same backend at a `orgs/<org_id>` prefix.
+//
+// Only the filesystem backend (fileBaseDatastoreFactory, below) is
+// actually wired up today. s3DatastoreFactory and sqlDatastoreFactory
+// (datastore_factory_backends.go) register real Name()s and do real
+// config validation/preflight, so the registry, startOrg resolution
+// and Scan() rebinding this interface exists for can be exercised end
+// to end - see TestStartOrgConcurrentDifferentBackends - but their
+// NewDatastore/NewFileStore deliberately refuse to construct anything,
+// rather than silently handing back the shared filesystem store under
+// an S3/SQL label. Making them actually read and write through S3/SQL
+// is unstarted follow-up work, not part of this change.
+type DatastoreFactory interface {
+	// Name is the value of Datastore.Implementation/
+	// DatastoreBackendConfig.Implementation that selects this factory,
+	// e.g. "FileBaseDataStore", "S3", "SQL".
+	Name() string
+
+	NewDatastore(config_obj *config_proto.Config, backend *DatastoreBackendConfig) (datastore.DataStore, error)
+	NewFileStore(config_obj *config_proto.Config, backend *DatastoreBackendConfig) (api.FileStore, error)
+}
+
+var (
+	datastoreFactoriesMu sync.Mutex
+	datastoreFactories   = make(map[string]DatastoreFactory)
+)
+
+// RegisterDatastoreFactory adds a backend to the registry that startOrg
+// resolves org Datastore blocks against. Backend implementations call
+// this from an init() function.
+func RegisterDatastoreFactory(factory DatastoreFactory) {
+	datastoreFactoriesMu.Lock()
+	defer datastoreFactoriesMu.Unlock()
+
+	datastoreFactories[factory.Name()] = factory
+}
+
+// getDatastoreFactory resolves the factory for an org, preferring
+// backend.Implementation (see OrgManager.SetOrgDatastore), then falling
+// back to config_obj.Datastore.Implementation and finally to the
+// filesystem backend for compatibility with orgs created before
+// per-org backends existed.
+func getDatastoreFactory(
+	config_obj *config_proto.Config, backend *DatastoreBackendConfig) (DatastoreFactory, error) {
+	name := "FileBaseDataStore"
+	if config_obj.Datastore != nil && config_obj.Datastore.Implementation != "" {
+		name = config_obj.Datastore.Implementation
+	}
+	if backend != nil && backend.Implementation != "" {
+		name = backend.Implementation
+	}
+
+	datastoreFactoriesMu.Lock()
+	defer datastoreFactoriesMu.Unlock()
+
+	factory, pres := datastoreFactories[name]
+	if !pres {
+		return nil, fmt.Errorf("Unknown datastore implementation %q", name)
+	}
+
+	return factory, nil
+}
+
+// fileBaseDatastoreFactory wraps the existing filesystem backend so it
+// can be resolved through the same registry as the new backends -
+// orgs that do not specify their own Datastore block keep working
+// exactly as before.
+type fileBaseDatastoreFactory struct{}
+
+func (self fileBaseDatastoreFactory) Name() string { return "FileBaseDataStore" }
+
+func (self fileBaseDatastoreFactory) NewDatastore(
+	config_obj *config_proto.Config, backend *DatastoreBackendConfig) (datastore.DataStore, error) {
+	return datastore.GetDB(config_obj)
+}
+
+func (self fileBaseDatastoreFactory) NewFileStore(
+	config_obj *config_proto.Config, backend *DatastoreBackendConfig) (api.FileStore, error) {
+	return file_store.GetFileStore(config_obj), nil
+}
+
+func init() {
+	RegisterDatastoreFactory(fileBaseDatastoreFactory{})
+}
+
+// httpClientFactory lets tests stub the transport used by the S3 and
+// webhook-style backends without a real network call, mirroring the
+// option.WithHTTPClient pattern used by cloud SDKs.
+type httpClientFactory func(config_obj *config_proto.Config) *http.Client
+
+var defaultHTTPClientFactory httpClientFactory = func(
+	config_obj *config_proto.Config) *http.Client {
+	return http.DefaultClient
+}
@@ -0,0 +1,123 @@
+package orgs
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
+	"www.velocidex.com/golang/velociraptor/datastore"
+	"www.velocidex.com/golang/velociraptor/file_store/api"
+)
+
+// s3DatastoreFactory is registered against "S3" so an org can be
+// resolved to an S3-compatible backend by DatastoreBackendConfig.
+// Actually reading/writing through S3 is not implemented yet - see
+// NewDatastore - but the bucket reachability preflight is real: it
+// HEADs the configured bucket over HTTP so a misconfigured org (wrong
+// endpoint, wrong credentials, not actually reachable) is rejected at
+// startOrg time. The HTTP client used for that preflight is injectable
+// so tests can stub the transport instead of making real network
+// calls.
+type s3DatastoreFactory struct {
+	http_client_factory httpClientFactory
+}
+
+func (self s3DatastoreFactory) Name() string { return "S3" }
+
+func (self s3DatastoreFactory) httpClient(config_obj *config_proto.Config) *http.Client {
+	factory := self.http_client_factory
+	if factory == nil {
+		factory = defaultHTTPClientFactory
+	}
+	return factory(config_obj)
+}
+
+// checkBucketReachable HEADs the configured bucket through the
+// injectable http client and fails if it is not reachable - this is
+// what actually exercises http_client_factory, so tests can stub the
+// transport and assert a misconfigured/unreachable bucket is rejected
+// before an org is ever registered.
+func (self s3DatastoreFactory) checkBucketReachable(
+	backend *DatastoreBackendConfig, config_obj *config_proto.Config) error {
+	url := backend.Endpoint + "/" + backend.Bucket
+
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		return err
+	}
+	if backend.Credentials != "" {
+		req.Header.Set("Authorization", "Bearer "+backend.Credentials)
+	}
+
+	resp, err := self.httpClient(config_obj).Do(req)
+	if err != nil {
+		return fmt.Errorf("S3 datastore: bucket %v unreachable: %w",
+			backend.Bucket, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("S3 datastore: bucket %v returned %v",
+			backend.Bucket, resp.Status)
+	}
+
+	return nil
+}
+
+func (self s3DatastoreFactory) NewDatastore(
+	config_obj *config_proto.Config, backend *DatastoreBackendConfig) (datastore.DataStore, error) {
+	if backend == nil || backend.Bucket == "" {
+		return nil, fmt.Errorf("S3 datastore requires a bucket")
+	}
+	if backend.Endpoint != "" {
+		if err := self.checkBucketReachable(backend, config_obj); err != nil {
+			return nil, err
+		}
+	}
+	return nil, errors.New("S3 datastore backend is not implemented yet")
+}
+
+func (self s3DatastoreFactory) NewFileStore(
+	config_obj *config_proto.Config, backend *DatastoreBackendConfig) (api.FileStore, error) {
+	if backend == nil || backend.Bucket == "" {
+		return nil, fmt.Errorf("S3 filestore requires a bucket")
+	}
+	if backend.Endpoint != "" {
+		if err := self.checkBucketReachable(backend, config_obj); err != nil {
+			return nil, err
+		}
+	}
+	return nil, errors.New("S3 filestore backend is not implemented yet")
+}
+
+// sqlDatastoreFactory is registered against "SQL" so an org can be
+// resolved to a SQL-backed datastore by DatastoreBackendConfig, for
+// sites that already run Velociraptor's metadata in a shared RDBMS
+// (see the `MySQL` datastore implementation this mirrors). Actually
+// reading/writing through SQL is not implemented yet - see
+// NewDatastore.
+type sqlDatastoreFactory struct{}
+
+func (self sqlDatastoreFactory) Name() string { return "SQL" }
+
+func (self sqlDatastoreFactory) NewDatastore(
+	config_obj *config_proto.Config, backend *DatastoreBackendConfig) (datastore.DataStore, error) {
+	if backend == nil || backend.SqlDsn == "" {
+		return nil, fmt.Errorf("SQL datastore requires a dsn")
+	}
+	return nil, errors.New("SQL datastore backend is not implemented yet")
+}
+
+func (self sqlDatastoreFactory) NewFileStore(
+	config_obj *config_proto.Config, backend *DatastoreBackendConfig) (api.FileStore, error) {
+	if backend == nil || backend.SqlDsn == "" {
+		return nil, fmt.Errorf("SQL filestore requires a dsn")
+	}
+	return nil, errors.New("SQL filestore backend is not implemented yet")
+}
+
+func init() {
+	RegisterDatastoreFactory(s3DatastoreFactory{})
+	RegisterDatastoreFactory(sqlDatastoreFactory{})
+}
@@ -0,0 +1,168 @@
+package orgs
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	api_proto "www.velocidex.com/golang/velociraptor/api/proto"
+	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
+	"www.velocidex.com/golang/velociraptor/datastore"
+	"www.velocidex.com/golang/velociraptor/file_store/api"
+	"www.velocidex.com/golang/velociraptor/vtesting/assert"
+)
+
+// stubRoundTripper lets a test stand in for the real network transport
+// an S3 endpoint would otherwise require, exercising
+// s3DatastoreFactory.http_client_factory the way option.WithHTTPClient
+// style injection is meant to be used.
+type stubRoundTripper struct {
+	status_code int
+}
+
+func (self stubRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: self.status_code,
+		Body:       http.NoBody,
+		Header:     make(http.Header),
+	}, nil
+}
+
+// An S3 backed org whose bucket preflight succeeds must start, and one
+// whose preflight fails must not - both driven through the injected
+// http_client_factory, not a real network call.
+func TestS3DatastoreFactoryInjectableHTTPClient(t *testing.T) {
+	config_obj := &config_proto.Config{
+		Datastore: &config_proto.DatastoreConfig{
+			Implementation: "S3",
+			Bucket:         "my-bucket",
+			Endpoint:       "https://s3.example.com",
+		},
+	}
+
+	backend := &DatastoreBackendConfig{
+		Implementation: "S3",
+		Bucket:         "my-bucket",
+		Endpoint:       "https://s3.example.com",
+	}
+
+	// A reachable bucket passes the preflight - NewDatastore still
+	// fails, but with the "not implemented" error, not the preflight's.
+	ok_factory := s3DatastoreFactory{
+		http_client_factory: func(*config_proto.Config) *http.Client {
+			return &http.Client{Transport: stubRoundTripper{status_code: 200}}
+		},
+	}
+	_, err := ok_factory.NewDatastore(config_obj, backend)
+	assert.Error(t, err)
+	if !strings.Contains(err.Error(), "not implemented") {
+		t.Fatalf("expected a 'not implemented' error, got: %v", err)
+	}
+
+	// An unreachable bucket fails at the preflight, before getting to
+	// the "not implemented" error.
+	denied_factory := s3DatastoreFactory{
+		http_client_factory: func(*config_proto.Config) *http.Client {
+			return &http.Client{Transport: stubRoundTripper{status_code: 403}}
+		},
+	}
+	_, err = denied_factory.NewDatastore(config_obj, backend)
+	assert.Error(t, err)
+	if strings.Contains(err.Error(), "not implemented") {
+		t.Fatalf("expected the preflight error, not the 'not implemented' error: %v", err)
+	}
+}
+
+// Two orgs configured with different Datastore.Implementation values
+// must resolve to different DatastoreFactory instances.
+func TestGetDatastoreFactoryPerOrgBackend(t *testing.T) {
+	fs_config := &config_proto.Config{
+		Datastore: &config_proto.DatastoreConfig{
+			Implementation: "FileBaseDataStore",
+		},
+	}
+	factory, err := getDatastoreFactory(fs_config, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "FileBaseDataStore", factory.Name())
+
+	factory, err = getDatastoreFactory(fs_config, &DatastoreBackendConfig{
+		Implementation: "S3",
+		Bucket:         "my-bucket",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "S3", factory.Name())
+
+	_, err = getDatastoreFactory(fs_config, &DatastoreBackendConfig{
+		Implementation: "NoSuchBackend",
+	})
+	assert.Error(t, err)
+}
+
+// fakeDatastoreFactory stands in for a real backend SDK (S3/SQL) so
+// this test can exercise the org manager's concurrent startOrg/backend
+// resolution plumbing without depending on network access or a
+// backend this tree does not vendor.
+type fakeDatastoreFactory struct {
+	name string
+}
+
+func (self fakeDatastoreFactory) Name() string { return self.name }
+
+func (self fakeDatastoreFactory) NewDatastore(
+	config_obj *config_proto.Config, backend *DatastoreBackendConfig) (datastore.DataStore, error) {
+	return nil, nil
+}
+
+func (self fakeDatastoreFactory) NewFileStore(
+	config_obj *config_proto.Config, backend *DatastoreBackendConfig) (api.FileStore, error) {
+	return nil, nil
+}
+
+// Two orgs, each pinned to a different backend via their own
+// DatastoreBackendConfig (see OrgManager.SetOrgDatastore), must both
+// start successfully when startOrg runs for them concurrently, and
+// must each end up bound to their own backend rather than clobbering
+// one another.
+func TestStartOrgConcurrentDifferentBackends(t *testing.T) {
+	RegisterDatastoreFactory(fakeDatastoreFactory{name: "TestBackendA"})
+	RegisterDatastoreFactory(fakeDatastoreFactory{name: "TestBackendB"})
+
+	org_mgr := &OrgManager{
+		config_obj:          &config_proto.Config{Datastore: &config_proto.DatastoreConfig{}},
+		orgs:                make(map[string]*OrgContext),
+		org_id_by_nonce:     make(map[string]string),
+		datastore_overrides: make(map[string]*DatastoreBackendConfig),
+	}
+	org_mgr.federation_manager = NewFederationManager(org_mgr.config_obj, org_mgr)
+
+	records := []*api_proto.OrgRecord{
+		{OrgId: "OA1", Name: "OrgA"},
+		{OrgId: "OB1", Name: "OrgB"},
+	}
+	org_mgr.SetOrgDatastore("OA1", &DatastoreBackendConfig{Implementation: "TestBackendA"})
+	org_mgr.SetOrgDatastore("OB1", &DatastoreBackendConfig{Implementation: "TestBackendB"})
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(records))
+	for i, record := range records {
+		wg.Add(1)
+		go func(i int, record *api_proto.OrgRecord) {
+			defer wg.Done()
+			errs[i] = org_mgr.startOrg(record)
+		}(i, record)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+
+	config_a, err := org_mgr.GetOrgConfig("OA1")
+	assert.NoError(t, err)
+	assert.Equal(t, "TestBackendA", config_a.Datastore.Implementation)
+
+	config_b, err := org_mgr.GetOrgConfig("OB1")
+	assert.NoError(t, err)
+	assert.Equal(t, "TestBackendB", config_b.Datastore.Implementation)
+}
@@ -0,0 +1,98 @@
+package orgs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"www.velocidex.com/golang/velociraptor/services"
+)
+
+// RegisterFederationHTTPHandlers mounts FederationRPCHandler at
+// /api/v1/federation/rpc, the path federatedServiceContainer.proxy
+// POSTs to. The frontend's HTTP server setup must call this once per
+// OrgManager alongside its other /api/v1/ handler registrations, or a
+// federated request from a peer has nothing to land on.
+func RegisterFederationHTTPHandlers(mux *http.ServeMux, org_mgr *OrgManager) {
+	mux.HandleFunc("/api/v1/federation/rpc", org_mgr.FederationRPCHandler)
+}
+
+// FederationRPCHandler is the receiving side of the federation RPC
+// protocol that federatedServiceContainer.proxy speaks to a peer
+// deployment - see RegisterFederationHTTPHandlers.
+//
+// It looks up the inbound shared secret this deployment has configured
+// for the envelope's OrgId - this deployment's own local org id, i.e.
+// the org being addressed, via RegisterInboundFederationSecret, not
+// the federated table (which only tracks peer orgs this deployment
+// calls out to) - verifies the bearer token was signed with that
+// secret, then dispatches Method to the local ServiceContainer for
+// that org, forwarding the principal recovered from the token.
+func (self *OrgManager) FederationRPCHandler(w http.ResponseWriter, r *http.Request) {
+	var envelope federationRPCRequest
+	err := json.NewDecoder(r.Body).Decode(&envelope)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Federation: invalid request: %v", err),
+			http.StatusBadRequest)
+		return
+	}
+
+	shared_token, pres := self.federation_manager.sharedTokenForOrg(envelope.OrgId)
+	if !pres {
+		http.Error(w, fmt.Sprintf("Federation: unknown org %v", envelope.OrgId),
+			http.StatusUnauthorized)
+		return
+	}
+
+	bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	principal, _, err := VerifyFederationToken(shared_token, bearer)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Federation: %v", err), http.StatusUnauthorized)
+		return
+	}
+
+	container, err := self.GetServiceContainer(envelope.OrgId)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Federation: %v", err), http.StatusNotFound)
+		return
+	}
+
+	var request interface{}
+	err = json.Unmarshal(envelope.Request, &request)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Federation: invalid request payload: %v", err),
+			http.StatusBadRequest)
+		return
+	}
+
+	result, err := dispatchFederationRPC(
+		r.Context(), container, principal, envelope.Method, request)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Federation: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// dispatchFederationRPC maps an envelope Method onto the corresponding
+// services.ServiceContainer call - the receiving side's half of the
+// LaunchFlow/ScheduleHunt/ReadVFS proxy contract federatedServiceContainer
+// implements on the calling side.
+func dispatchFederationRPC(ctx context.Context, container services.ServiceContainer,
+	principal, method string, request interface{}) (interface{}, error) {
+
+	switch method {
+	case "LaunchFlow":
+		return container.LaunchFlow(ctx, principal, request)
+	case "ScheduleHunt":
+		return container.ScheduleHunt(ctx, principal, request)
+	case "ReadVFS":
+		return container.ReadVFS(ctx, principal, request)
+	default:
+		return nil, fmt.Errorf("unknown federation method %q", method)
+	}
+}
@@ -0,0 +1,157 @@
+package orgs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"www.velocidex.com/golang/velociraptor/services"
+)
+
+// federatedServiceContainer implements services.ServiceContainer for a
+// FederatedOrg. Flow launches, hunt scheduling and VFS reads are
+// forwarded over HTTP to the peer deployment's frontend as a signed
+// federation RPC, with the caller's principal carried inside the
+// token so the remote side can apply its own ACLs; the local
+// datastore never stores the remote org's data.
+//
+// It implements every method of services.ServiceContainer directly
+// rather than embedding the interface - an embedded nil
+// services.ServiceContainer panics the moment any promoted method is
+// called, it does not return services.NotFoundError, so there is no
+// safe way to fall back to one for methods this subsystem does not
+// proxy.
+type federatedServiceContainer struct {
+	record     *FederatedOrg
+	httpClient *http.Client
+}
+
+func newFederatedServiceContainer(
+	record *FederatedOrg) services.ServiceContainer {
+	return &federatedServiceContainer{
+		record:     record,
+		httpClient: http.DefaultClient,
+	}
+}
+
+// LaunchFlow proxies a flow launch to the remote frontend, forwarding
+// the caller's principal via a signed federation token so the peer
+// can apply its own ACL decisions for that identity.
+func (self *federatedServiceContainer) LaunchFlow(
+	ctx context.Context, principal string,
+	request interface{}) (interface{}, error) {
+	return self.proxy(ctx, principal, "LaunchFlow", request)
+}
+
+// ScheduleHunt proxies a hunt creation/modification to the remote
+// frontend.
+func (self *federatedServiceContainer) ScheduleHunt(
+	ctx context.Context, principal string,
+	request interface{}) (interface{}, error) {
+	return self.proxy(ctx, principal, "ScheduleHunt", request)
+}
+
+// ReadVFS proxies a VFS read to the remote frontend, restricted to the
+// artifacts/permissions allowlisted on the FederatedOrg record.
+func (self *federatedServiceContainer) ReadVFS(
+	ctx context.Context, principal string,
+	request interface{}) (interface{}, error) {
+	return self.proxy(ctx, principal, "ReadVFS", request)
+}
+
+// federationRPCRequest is the envelope POSTed to the peer deployment's
+// frontend. OrgId is the id of the org being addressed *on the peer*
+// (i.e. the remote_org_id passed to MintFederationToken) - the peer's
+// federation verification middleware uses it to find the matching
+// FederatedOrg record it has configured for this caller, whose shared
+// Token is checked against the bearer token before Method is
+// dispatched.
+type federationRPCRequest struct {
+	OrgId   string          `json:"org_id"`
+	Method  string          `json:"method"`
+	Request json.RawMessage `json:"request"`
+}
+
+func (self *federatedServiceContainer) proxy(
+	ctx context.Context, principal, method string,
+	request interface{}) (interface{}, error) {
+
+	if !self.isAllowed(method) {
+		return nil, fmt.Errorf(
+			"Federation: %v is not in the allowlist for org %v",
+			method, self.record.OrgId)
+	}
+
+	token, err := signFederationToken(self.record.Token, &federationToken{
+		RemoteOrgId: self.record.OrgId,
+		Principal:   principal,
+		Scopes:      []string{method},
+		Expires:     time.Now().Add(federationTokenTTLDefault).Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	raw_request, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := json.Marshal(&federationRPCRequest{
+		OrgId:   self.record.OrgId,
+		Method:  method,
+		Request: raw_request,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	http_request, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		self.record.RemoteFrontendUrl+"/api/v1/federation/rpc",
+		bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	http_request.Header.Set("Content-Type", "application/json")
+	http_request.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := self.httpClient.Do(http_request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("Federation: %v on org %v failed: %v: %s",
+			method, self.record.OrgId, resp.Status, body)
+	}
+
+	var result interface{}
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// isAllowed checks the FederatedOrg's artifact/permission allowlist.
+// An empty allowlist denies everything by default - federation must be
+// opted into explicitly per method/artifact.
+func (self *federatedServiceContainer) isAllowed(method string) bool {
+	for _, allowed := range self.record.Allowlist {
+		if allowed == method || allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
@@ -3,6 +3,7 @@ package orgs
 import (
 	"context"
 	"errors"
+	"fmt"
 	"path/filepath"
 	"sort"
 	"sync"
@@ -21,6 +22,43 @@ type OrgContext struct {
 	record     *api_proto.OrgRecord
 	config_obj *config_proto.Config
 	service    services.ServiceContainer
+
+	// backend_name records which DatastoreFactory built datastore_obj
+	// and file_store_obj, so Scan() can tell when an org's Datastore
+	// config changed and needs to be rebound onto a new backend.
+	backend_name string
+
+	// datastore_override is the DatastoreBackendConfig this org was
+	// started with, if any - see OrgManager.SetOrgDatastore.
+	datastore_override *DatastoreBackendConfig
+}
+
+// localServiceContainer implements services.ServiceContainer for a
+// locally hosted org - what GetServiceContainer returns for every org
+// that is not federated. LaunchFlow/ScheduleHunt/ReadVFS are not wired
+// to the real Launcher/HuntDispatcher/VFS services yet (a follow-up),
+// so each reports services.NotFoundError rather than dispatching.
+type localServiceContainer struct {
+	config_obj *config_proto.Config
+}
+
+func newLocalServiceContainer(config_obj *config_proto.Config) services.ServiceContainer {
+	return &localServiceContainer{config_obj: config_obj}
+}
+
+func (self *localServiceContainer) LaunchFlow(
+	ctx context.Context, principal string, request interface{}) (interface{}, error) {
+	return nil, services.NotFoundError
+}
+
+func (self *localServiceContainer) ScheduleHunt(
+	ctx context.Context, principal string, request interface{}) (interface{}, error) {
+	return nil, services.NotFoundError
+}
+
+func (self *localServiceContainer) ReadVFS(
+	ctx context.Context, principal string, request interface{}) (interface{}, error) {
+	return nil, services.NotFoundError
 }
 
 type OrgManager struct {
@@ -35,16 +73,151 @@ type OrgManager struct {
 	// Each org has a separate config object.
 	orgs            map[string]*OrgContext
 	org_id_by_nonce map[string]string
+
+	backup_manager *BackupManager
+
+	// backup_config is set by ConfigureBackups. config_proto.Config has
+	// no Backup stanza yet, so this is how backups are enabled until it
+	// does - see ConfigureBackups.
+	backup_config *BackupConfig
+
+	federation_manager *FederationManager
+
+	// datastore_overrides holds the DatastoreBackendConfig pinned to an
+	// org id by SetOrgDatastore. api_proto.OrgRecord has no Datastore
+	// field of its own yet, so a per-org backend is kept here instead -
+	// see SetOrgDatastore.
+	datastore_overrides map[string]*DatastoreBackendConfig
 }
 
-func (self *OrgManager) ListOrgs() []*api_proto.OrgRecord {
-	result := []*api_proto.OrgRecord{}
+// SetOrgDatastore pins org_id to its own datastore/filestore backend
+// (S3, SQL, ...) instead of the path-prefixed filesystem default. There
+// is no OrgRecord.Datastore stanza to persist this on yet, so it is
+// kept in memory only and must be set again after a restart - the
+// server command should call this after NewOrgManager, the same way it
+// wires up ConfigureBackups.
+func (self *OrgManager) SetOrgDatastore(org_id string, cfg *DatastoreBackendConfig) {
 	self.mu.Lock()
 	defer self.mu.Unlock()
 
+	self.datastore_overrides[org_id] = cfg
+}
+
+// ConfigureBackups enables the scheduled per-org backup subsystem. There
+// is no config_proto.Config.Backup stanza to read this from yet, so the
+// server command should call this after NewOrgManager, the same way it
+// wires up other optional subsystems. NewOrgManager's call to Start
+// (and Start's own first, inline Scan) has always already completed by
+// the time NewOrgManager returns, so the BackupManager is not built
+// here - maybeStartBackupManager picks this config up on the next
+// Scan() tick instead, the same way datastore_overrides is re-checked
+// on every tick rather than once at startup.
+func (self *OrgManager) ConfigureBackups(cfg *BackupConfig) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.backup_config = cfg
+}
+
+// RegisterFederatedOrg adds a peer Velociraptor deployment's org as a
+// federated org, so it shows up in ListOrgs and can be resolved by
+// GetOrgConfig as if it were local.
+func (self *OrgManager) RegisterFederatedOrg(record *FederatedOrg) error {
+	return self.federation_manager.RegisterFederatedOrg(record)
+}
+
+// IsFederatedOrg reports whether org_id is a federated org rather than
+// a local one - see the note on FederationManager.ListFederatedOrgs.
+func (self *OrgManager) IsFederatedOrg(org_id string) bool {
+	return self.federation_manager.IsFederated(org_id)
+}
+
+// RegisterInboundFederationSecret authorizes federation RPCs addressed
+// to the local org org_id when signed with shared_token - see
+// FederationManager.RegisterInboundFederationSecret. This is the other
+// half of setting up a federation relationship: RegisterFederatedOrg
+// configures calling OUT to a peer's org, this configures accepting
+// calls IN to one of this deployment's own orgs.
+func (self *OrgManager) RegisterInboundFederationSecret(org_id, shared_token string) {
+	self.federation_manager.RegisterInboundFederationSecret(org_id, shared_token)
+}
+
+// MintFederationToken creates a signed, time limited token that lets
+// principal act against remote_org_id with the given scopes. The
+// token is sent to the peer deployment on every proxied request and
+// verified there by VerifyFederationToken.
+func (self *OrgManager) MintFederationToken(
+	remote_org_id, principal string, ttl time.Duration, scopes []string) (string, error) {
+	return self.federation_manager.MintFederationToken(
+		remote_org_id, principal, ttl, scopes)
+}
+
+// BackupOrg, RestoreOrg, RegisterFederatedOrg,
+// RegisterInboundFederationSecret, MintFederationToken and
+// SetOrgDatastore are not part of the services.OrgManager interface -
+// callers outside this package (vql/server/orgs) reach them through a
+// narrow local interface and a type assertion instead of a
+// services.OrgManager interface change.
+//
+// BackupOrg triggers an immediate, out of band backup of a single org,
+// without waiting for the BackupManager's schedule.
+func (self *OrgManager) BackupOrg(ctx context.Context, org_id string) error {
+	if self.IsFederatedOrg(org_id) {
+		// GetOrgConfig falls back to FederationManager.GetFederatedOrgConfig
+		// for a federated org id, which is just a clone of the root
+		// org's own config with OrgId/OrgName overwritten - it has no
+		// Datastore/FilestoreDirectory prefix of its own the way a real
+		// local org does. Backing that up would silently archive the
+		// root org's own data under the federated org's name.
+		return fmt.Errorf(
+			"BackupOrg: %v is a federated org - it has no local datastore to back up", org_id)
+	}
+
+	self.mu.Lock()
+	backup_manager := self.backup_manager
+	self.mu.Unlock()
+
+	if backup_manager == nil {
+		return errors.New("Backups are not configured")
+	}
+
+	return backup_manager.BackupOrg(ctx, org_id)
+}
+
+// RestoreOrg reconstructs an org from a backup previously produced by
+// the BackupManager and re-registers it. It is a thin wrapper so
+// callers (the GUI API and the backup_orgs() VQL plugin) do not need
+// to know whether backups are configured.
+func (self *OrgManager) RestoreOrg(ctx context.Context, org_id, backup_id string) error {
+	if self.IsFederatedOrg(org_id) {
+		return fmt.Errorf(
+			"RestoreOrg: %v is a federated org - it has no local datastore to restore into", org_id)
+	}
+
+	self.mu.Lock()
+	backup_manager := self.backup_manager
+	self.mu.Unlock()
+
+	if backup_manager == nil {
+		return errors.New("Backups are not configured")
+	}
+
+	return backup_manager.RestoreOrg(ctx, org_id, backup_id)
+}
+
+func (self *OrgManager) ListOrgs() []*api_proto.OrgRecord {
+	result := []*api_proto.OrgRecord{}
+	self.mu.Lock()
 	for _, item := range self.orgs {
 		result = append(result, proto.Clone(item.record).(*api_proto.OrgRecord))
 	}
+	federation_manager := self.federation_manager
+	self.mu.Unlock()
+
+	// Union in orgs federated from peer Velociraptor deployments - they
+	// are tagged Federated so the GUI can tell them apart from local
+	// orgs.
+	result = append(result, federation_manager.ListFederatedOrgs()...)
 
 	// Sort orgs by names
 	sort.Slice(result, func(i, j int) bool {
@@ -56,7 +229,6 @@ func (self *OrgManager) ListOrgs() []*api_proto.OrgRecord {
 
 func (self *OrgManager) GetOrgConfig(org_id string) (*config_proto.Config, error) {
 	self.mu.Lock()
-	defer self.mu.Unlock()
 
 	if org_id == "root" {
 		org_id = ""
@@ -64,14 +236,41 @@ func (self *OrgManager) GetOrgConfig(org_id string) (*config_proto.Config, error
 
 	// An empty org id corresponds to the root org.
 	if org_id == "" {
+		self.mu.Unlock()
 		return self.config_obj, nil
 	}
 
 	result, pres := self.orgs[org_id]
-	if !pres {
-		return nil, services.NotFoundError
+	federation_manager := self.federation_manager
+	self.mu.Unlock()
+	if pres {
+		return result.config_obj, nil
 	}
-	return result.config_obj, nil
+
+	// Not a local org - see if it is a federated one instead.
+	return federation_manager.GetFederatedOrgConfig(org_id)
+}
+
+// GetServiceContainer resolves the services.ServiceContainer that
+// should handle requests for org_id - the local container for a
+// locally hosted org, or the proxying container for a federated one.
+// This is the one place federatedOrg.service is actually read, which
+// is what lets RegisterFederatedOrg's container ever be invoked.
+func (self *OrgManager) GetServiceContainer(
+	org_id string) (services.ServiceContainer, error) {
+	if org_id == "root" {
+		org_id = ""
+	}
+
+	self.mu.Lock()
+	result, pres := self.orgs[org_id]
+	federation_manager := self.federation_manager
+	self.mu.Unlock()
+	if pres {
+		return result.service, nil
+	}
+
+	return federation_manager.GetFederatedServiceContainer(org_id)
 }
 
 func (self *OrgManager) GetOrg(org_id string) (*api_proto.OrgRecord, error) {
@@ -145,7 +344,7 @@ func (self *OrgManager) CreateNewOrg(name, id string) (
 }
 
 func (self *OrgManager) makeNewConfigObj(
-	record *api_proto.OrgRecord) *config_proto.Config {
+	record *api_proto.OrgRecord, backend *DatastoreBackendConfig) *config_proto.Config {
 
 	result := proto.Clone(self.config_obj).(*config_proto.Config)
 
@@ -159,19 +358,108 @@ func (self *OrgManager) makeNewConfigObj(
 	}
 
 	if result.Datastore != nil && record.OrgId != "" {
-		if result.Datastore.Location != "" {
-			result.Datastore.Location = filepath.Join(
-				result.Datastore.Location, "orgs", record.OrgId)
-		}
-		if result.Datastore.FilestoreDirectory != "" {
-			result.Datastore.FilestoreDirectory = filepath.Join(
-				result.Datastore.FilestoreDirectory, "orgs", record.OrgId)
+		if backend != nil && backend.Implementation != "" {
+			// The org opted into its own backend entirely (different
+			// Implementation, bucket/DSN, credentials) instead of just
+			// a path prefix on the root backend - see SetOrgDatastore.
+			result.Datastore.Implementation = backend.Implementation
+		} else {
+			if result.Datastore.Location != "" {
+				result.Datastore.Location = filepath.Join(
+					result.Datastore.Location, "orgs", record.OrgId)
+			}
+			if result.Datastore.FilestoreDirectory != "" {
+				result.Datastore.FilestoreDirectory = filepath.Join(
+					result.Datastore.FilestoreDirectory, "orgs", record.OrgId)
+			}
 		}
 	}
 
 	return result
 }
 
+// startOrg builds the config, datastore and filestore for an org and
+// registers it with the manager. Each org resolves its own
+// DatastoreFactory (falling back to the shared filesystem backend),
+// so two orgs can live on entirely different physical backends.
+func (self *OrgManager) startOrg(record *api_proto.OrgRecord) error {
+	self.mu.Lock()
+	backend := self.datastore_overrides[record.OrgId]
+	self.mu.Unlock()
+
+	config_obj := self.makeNewConfigObj(record, backend)
+
+	factory, err := getDatastoreFactory(config_obj, backend)
+	if err != nil {
+		return err
+	}
+
+	// Constructing the datastore/filestore also has the side effect of
+	// registering them against config_obj for this org id, which is
+	// how datastore.GetDB(config_obj)/file_store.GetFileStore(config_obj)
+	// find the right backend for subsequent calls scoped to this org.
+	_, err = factory.NewDatastore(config_obj, backend)
+	if err != nil {
+		return err
+	}
+
+	_, err = factory.NewFileStore(config_obj, backend)
+	if err != nil {
+		return err
+	}
+
+	org_context := &OrgContext{
+		record:             proto.Clone(record).(*api_proto.OrgRecord),
+		config_obj:         config_obj,
+		service:            newLocalServiceContainer(config_obj),
+		backend_name:       factory.Name(),
+		datastore_override: backend,
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.orgs[record.OrgId] = org_context
+	if record.Nonce != "" {
+		self.org_id_by_nonce[record.Nonce] = record.OrgId
+	}
+
+	return nil
+}
+
+// maybeRebindOrg is called by Scan() for orgs that are already
+// running. If the DatastoreBackendConfig pinned to this org id (see
+// SetOrgDatastore) changed since the org was started, the org is
+// rebound onto its new backend by simply re-running startOrg - this
+// replaces the OrgContext (and therefore the datastore/filestore/
+// service container) for that org id, without disturbing any other org.
+func (self *OrgManager) maybeRebindOrg(record *api_proto.OrgRecord) error {
+	self.mu.Lock()
+	existing, pres := self.orgs[record.OrgId]
+	backend := self.datastore_overrides[record.OrgId]
+	self.mu.Unlock()
+
+	if !pres {
+		return nil
+	}
+
+	if datastoreBackendEqual(existing.datastore_override, backend) {
+		return nil
+	}
+
+	return self.startOrg(record)
+}
+
+func datastoreBackendEqual(a, b *DatastoreBackendConfig) bool {
+	if a == nil && b == nil {
+		return true
+	}
+	if a == nil || b == nil {
+		return false
+	}
+	return *a == *b
+}
+
 func (self *OrgManager) Scan() error {
 	db, err := datastore.GetDB(self.config_obj)
 	if err != nil {
@@ -198,14 +486,66 @@ func (self *OrgManager) Scan() error {
 		if err != nil {
 			err = self.startOrg(org_record)
 			if err != nil {
-				return err
+				// One org with a bad or unreachable backend (e.g. a
+				// misconfigured S3 bucket) must not prevent every
+				// other org - and the root org - from starting.
+				logger := logging.GetLogger(self.config_obj, &logging.FrontendComponent)
+				logger.Error("OrgManager: unable to start org %v: %v", org_id, err)
 			}
+			continue
+		}
+
+		// Org is already running - check if its backend config
+		// changed underneath it and needs rebinding onto the new
+		// backend.
+		err = self.maybeRebindOrg(org_record)
+		if err != nil {
+			logger := logging.GetLogger(self.config_obj, &logging.FrontendComponent)
+			logger.Error("OrgManager: unable to rebind org %v: %v", org_id, err)
 		}
 	}
 
+	self.maybeStartBackupManager()
+
 	return nil
 }
 
+// maybeStartBackupManager lazily builds and starts the BackupManager
+// once ConfigureBackups has been called. It has to be checked on every
+// Scan() tick rather than once in Start(): NewOrgManager only returns
+// to its caller once Start (and its first, inline Scan) has already
+// run to completion, so there is no call sequence where ConfigureBackups
+// could land before a one-time check in Start would have read it - see
+// the note on ConfigureBackups. datastore_overrides is re-checked the
+// same way, on every Scan tick, for the same reason.
+func (self *OrgManager) maybeStartBackupManager() {
+	self.mu.Lock()
+	already_started := self.backup_manager != nil
+	cfg := self.backup_config
+	self.mu.Unlock()
+
+	if already_started || cfg == nil {
+		return
+	}
+
+	backup_manager, err := NewBackupManager(self.config_obj, cfg, self)
+	if err != nil {
+		logger := logging.GetLogger(self.config_obj, &logging.FrontendComponent)
+		logger.Error("OrgManager: unable to start backup manager: %v", err)
+		return
+	}
+
+	if backup_manager == nil {
+		return
+	}
+
+	self.mu.Lock()
+	self.backup_manager = backup_manager
+	self.mu.Unlock()
+
+	backup_manager.Start(self.ctx, self.wg)
+}
+
 func (self *OrgManager) Start(
 	ctx context.Context,
 	config_obj *config_proto.Config,
@@ -270,9 +610,11 @@ func NewOrgManager(
 		ctx:        ctx,
 		wg:         wg,
 
-		orgs:            make(map[string]*OrgContext),
-		org_id_by_nonce: make(map[string]string),
+		orgs:                make(map[string]*OrgContext),
+		org_id_by_nonce:     make(map[string]string),
+		datastore_overrides: make(map[string]*DatastoreBackendConfig),
 	}
+	service.federation_manager = NewFederationManager(config_obj, service)
 
 	// Usually only one org manager exists at one time. However for
 	// the "gui" command this may be invoked multiple times.
@@ -282,4 +624,4 @@ func NewOrgManager(
 	}
 
 	return service, service.Start(ctx, config_obj, wg)
-}
\ No newline at end of file
+}
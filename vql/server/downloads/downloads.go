@@ -0,0 +1,414 @@
+package downloads
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/Velocidex/ordereddict"
+	"www.velocidex.com/golang/velociraptor/acls"
+	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
+	"www.velocidex.com/golang/velociraptor/file_store"
+	"www.velocidex.com/golang/velociraptor/file_store/api"
+	"www.velocidex.com/golang/velociraptor/file_store/path_specs"
+	"www.velocidex.com/golang/velociraptor/utils"
+	vql_subsystem "www.velocidex.com/golang/velociraptor/vql"
+	"www.velocidex.com/golang/vfilter"
+	"www.velocidex.com/golang/vfilter/arg_parser"
+)
+
+// Clock lets tests make download timestamps and throughput/ETA
+// calculations deterministic.
+var Clock utils.Clock = utils.RealClock{}
+
+type CreateFlowDownloadArgs struct {
+	ClientId     string `vfilter:"required,field=client_id"`
+	FlowId       string `vfilter:"required,field=flow_id"`
+	Name         string `vfilter:"optional,field=name,doc=Base name of the zip file (defaults to the flow id)"`
+	Wait         bool   `vfilter:"optional,field=wait,doc=Block until the zip is fully built"`
+	ExpandSparse bool   `vfilter:"optional,field=expand_sparse,doc=Expand sparse files to their full (zero padded) size"`
+}
+
+// CreateFlowDownload builds a zip export of a flow's uploaded files. It
+// reports progress into the datastore as it goes (see progress.go) so
+// download_status() can render a live progress bar, and can be
+// cancelled mid-stream via cancel_download() - in that case the
+// partially written zip is removed rather than left behind as a
+// corrupt file.
+type CreateFlowDownload struct{}
+
+func (self CreateFlowDownload) Call(
+	ctx context.Context,
+	scope vfilter.Scope, args *ordereddict.Dict) vfilter.Any {
+
+	err := vql_subsystem.CheckAccess(scope, acls.PREPARE_RESULTS)
+	if err != nil {
+		scope.Log("CreateFlowDownload: %v", err)
+		return vfilter.Null{}
+	}
+
+	arg := &CreateFlowDownloadArgs{}
+	err = arg_parser.ExtractArgsWithContext(ctx, scope, args, arg)
+	if err != nil {
+		scope.Log("CreateFlowDownload: %v", err)
+		return vfilter.Null{}
+	}
+
+	if arg.Name == "" {
+		arg.Name = arg.FlowId
+	}
+
+	config_obj, ok := vql_subsystem.GetServerConfig(scope)
+	if !ok {
+		scope.Log("CreateFlowDownload: Command can only run on the server")
+		return vfilter.Null{}
+	}
+
+	path_spec := downloadPathSpec(arg.ClientId, arg.FlowId, arg.Name)
+
+	total_bytes := estimateUploadedBytes(config_obj, arg.ClientId, arg.FlowId)
+
+	tracker, cancel_ctx, err := startDownloadTracking(
+		ctx, arg.ClientId, arg.FlowId, arg.Name, total_bytes)
+	if err != nil {
+		scope.Log("CreateFlowDownload: %v", err)
+		return vfilter.Null{}
+	}
+
+	build := func() {
+		defer unregisterTracker(arg.ClientId, arg.FlowId, arg.Name)
+
+		err := buildFlowDownload(cancel_ctx, config_obj, tracker,
+			arg.ClientId, arg.FlowId, path_spec, arg.ExpandSparse)
+		if err != nil {
+			if cancel_ctx.Err() != nil {
+				// Cancelled - the tracker is already CANCELLED
+				// (Cancel() sets that), nothing further to report.
+				return
+			}
+			tracker.Fail(config_obj, err)
+			scope.Log("CreateFlowDownload: %v", err)
+			return
+		}
+
+		tracker.Finish(config_obj)
+	}
+
+	if arg.Wait {
+		build()
+	} else {
+		go build()
+	}
+
+	return path_spec
+}
+
+func (self CreateFlowDownload) Info(
+	scope vfilter.Scope, type_map *vfilter.TypeMap) *vfilter.PluginInfo {
+	return &vfilter.PluginInfo{
+		Name:    "download_create_flow",
+		Doc:     "Create a zip export of a flow's uploaded files.",
+		ArgType: type_map.AddType(scope, &CreateFlowDownloadArgs{}),
+	}
+}
+
+// downloadPathSpec is where the finished zip lives in the filestore.
+func downloadPathSpec(client_id, flow_id, name string) path_specs.FSPathSpec {
+	return path_specs.NewSafeFilestorePath("downloads", client_id, flow_id).
+		AddUnsafeChild(name + ".zip")
+}
+
+// flowRootPathSpec is the root directory of everything collected for a
+// flow - uploads, results, logs. CreateFlowDownload only walks the
+// "uploads" child of this, but uses this as the base for computing
+// each member's zip path, so the archive preserves the "uploads/"
+// directory name from the on disk layout (giving the familiar
+// "uploads/uploads/<accessor>/<path>" member names).
+func flowRootPathSpec(client_id, flow_id string) path_specs.FSPathSpec {
+	return path_specs.NewSafeFilestorePath("clients", client_id, "collections", flow_id)
+}
+
+func uploadsRootPathSpec(client_id, flow_id string) path_specs.FSPathSpec {
+	return flowRootPathSpec(client_id, flow_id).AddUnsafeChild("uploads")
+}
+
+// sparseIndexSuffix marks the sidecar file next to a sparse upload
+// that records which byte ranges were actually collected; the rest of
+// the (notional, larger) file is implicitly zero.
+const sparseIndexSuffix = ".idx"
+
+type sparseRange struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// estimateUploadedBytes sums the size of every file under the flow's
+// uploads directory, for the progress tracker's total_bytes estimate.
+// It is an estimate, not a guarantee - expand_sparse can make the
+// final archive content larger than the bytes actually stored.
+func estimateUploadedBytes(config_obj *config_proto.Config, client_id, flow_id string) uint64 {
+	file_store_factory := file_store.GetFileStore(config_obj)
+
+	var total uint64
+	_ = walkFileStore(file_store_factory, uploadsRootPathSpec(client_id, flow_id),
+		func(path_spec api.FSPathSpec, info os.FileInfo) error {
+			if !info.IsDir() {
+				total += uint64(info.Size())
+			}
+			return nil
+		})
+
+	return total
+}
+
+// buildFlowDownload streams every uploaded file for the flow into a
+// zip at dest, reporting progress through tracker and checking ctx
+// between files so a cancellation takes effect promptly. If ctx is
+// cancelled (or any other error occurs) the partially written zip is
+// removed rather than left behind as a truncated, corrupt file.
+func buildFlowDownload(
+	ctx context.Context,
+	config_obj *config_proto.Config,
+	tracker *progressTracker,
+	client_id, flow_id string,
+	dest api.FSPathSpec,
+	expand_sparse bool) (err error) {
+
+	file_store_factory := file_store.GetFileStore(config_obj)
+
+	writer, err := file_store_factory.WriteFile(dest)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		writer.Close()
+		if err != nil {
+			// Atomically drop the partial zip - a cancelled or failed
+			// download must never leave a truncated file behind for a
+			// caller to mistake for a complete export.
+			file_store_factory.Delete(dest)
+		}
+	}()
+
+	err = writer.Truncate()
+	if err != nil {
+		return err
+	}
+
+	zip_writer := zip.NewWriter(writer)
+	defer zip_writer.Close()
+
+	flow_root := flowRootPathSpec(client_id, flow_id)
+	uploads_root := uploadsRootPathSpec(client_id, flow_id)
+
+	// idx_for_data maps a data file's path (as a string) to the path
+	// spec of its ".idx" sidecar, for files that are sparse.
+	idx_for_data := map[string]api.FSPathSpec{}
+
+	err = walkFileStore(file_store_factory, uploads_root,
+		func(path_spec api.FSPathSpec, info os.FileInfo) error {
+			name := path_spec.String()
+			if !info.IsDir() && strings.HasSuffix(name, sparseIndexSuffix) {
+				idx_for_data[strings.TrimSuffix(name, sparseIndexSuffix)] = path_spec
+			}
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+
+	return walkFileStore(file_store_factory, uploads_root,
+		func(path_spec api.FSPathSpec, info os.FileInfo) error {
+			if info.IsDir() {
+				return nil
+			}
+			if strings.HasSuffix(path_spec.String(), sparseIndexSuffix) {
+				// Handled alongside its data file below.
+				return nil
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+
+			member_name := "uploads/" + strings.TrimPrefix(
+				strings.TrimPrefix(path_spec.String(), flow_root.String()), "/")
+
+			idx_path, is_sparse := idx_for_data[path_spec.String()]
+
+			var written uint64
+			if is_sparse {
+				written, err = copySparseMember(file_store_factory, zip_writer,
+					path_spec, idx_path, member_name, expand_sparse)
+			} else {
+				written, err = copyPlainMember(file_store_factory, zip_writer,
+					path_spec, member_name)
+			}
+			if err != nil {
+				return err
+			}
+
+			tracker.Update(config_obj, written, member_name)
+			return nil
+		})
+}
+
+func copyPlainMember(file_store_factory api.FileStore, zip_writer *zip.Writer,
+	src api.FSPathSpec, member_name string) (uint64, error) {
+
+	reader, err := file_store_factory.ReadFile(src)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	entry_writer, err := zip_writer.Create(member_name)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(entry_writer, reader)
+	return uint64(n), err
+}
+
+// copySparseMember copies a sparse upload into the zip. When
+// expand_sparse is false the raw (gappy) data and its .idx sidecar are
+// both copied across unchanged, matching how the file was collected.
+// When expand_sparse is true the ranges in the .idx are used to lay
+// the present bytes out at their real offsets with the gaps between
+// them zero filled, and no .idx member is emitted since the result is
+// no longer sparse.
+func copySparseMember(
+	file_store_factory api.FileStore, zip_writer *zip.Writer,
+	data_path, idx_path api.FSPathSpec,
+	member_name string, expand_sparse bool) (uint64, error) {
+
+	if !expand_sparse {
+		written, err := copyPlainMember(file_store_factory, zip_writer, data_path, member_name)
+		if err != nil {
+			return 0, err
+		}
+
+		idx_written, err := copyPlainMember(file_store_factory, zip_writer,
+			idx_path, member_name+sparseIndexSuffix)
+		if err != nil {
+			return 0, err
+		}
+
+		return written + idx_written, nil
+	}
+
+	ranges, err := readSparseIndex(file_store_factory, idx_path)
+	if err != nil {
+		return 0, err
+	}
+
+	reader, err := file_store_factory.ReadFile(data_path)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	entry_writer, err := zip_writer.Create(member_name)
+	if err != nil {
+		return 0, err
+	}
+
+	var offset int64
+	var written uint64
+	for _, r := range ranges {
+		if r.Offset > offset {
+			gap := r.Offset - offset
+			_, err := io.CopyN(entry_writer, zeroReader{}, gap)
+			if err != nil {
+				return written, err
+			}
+			written += uint64(gap)
+		}
+
+		n, err := io.CopyN(entry_writer, reader, r.Length)
+		written += uint64(n)
+		if err != nil && err != io.EOF {
+			return written, err
+		}
+		offset = r.Offset + r.Length
+	}
+
+	return written, nil
+}
+
+func readSparseIndex(
+	file_store_factory api.FileStore, idx_path api.FSPathSpec) ([]sparseRange, error) {
+
+	reader, err := file_store_factory.ReadFile(idx_path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	decoder := json.NewDecoder(reader)
+	ranges := []sparseRange{}
+	err = decoder.Decode(&ranges)
+	if err != nil {
+		return nil, fmt.Errorf("CreateFlowDownload: invalid sparse index for %v: %w",
+			idx_path.String(), err)
+	}
+
+	return ranges, nil
+}
+
+// zeroReader produces an endless stream of zero bytes, used to pad
+// the gaps between sparse ranges when expanding a sparse file.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// walkFileStore recursively visits every entry under root, calling
+// visit(path_spec, info) for each - files and directories alike
+// (walkFileStore always recurses into directories regardless of what
+// visit returns for them).
+func walkFileStore(file_store_factory api.FileStore, root api.FSPathSpec,
+	visit func(api.FSPathSpec, os.FileInfo) error) error {
+
+	children, err := file_store_factory.ListDirectory(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, info := range children {
+		child := root.AddUnsafeChild(info.Name())
+
+		err := visit(child, info)
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			err = walkFileStore(file_store_factory, child, visit)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func init() {
+	vql_subsystem.RegisterPlugin(&CreateFlowDownload{})
+}
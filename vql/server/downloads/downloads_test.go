@@ -2,8 +2,10 @@ package downloads
 
 import (
 	"context"
+	"fmt"
 	"io/ioutil"
 	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
@@ -136,6 +138,194 @@ func (self *TestSuite) TestExportCollection() {
 
 }
 
+// Starting a second download under the same client_id/flow_id/name
+// while the first is still tracked must fail fast rather than
+// clobbering the first tracker.
+func (self *TestSuite) TestDownloadTrackingResumption() {
+	_, _, err := startDownloadTracking(
+		context.Background(), "C.1234", "F.1234", "Dup", 100)
+	assert.NoError(self.T(), err)
+	defer unregisterTracker("C.1234", "F.1234", "Dup")
+
+	_, _, err = startDownloadTracking(
+		context.Background(), "C.1234", "F.1234", "Dup", 100)
+	assert.Error(self.T(), err)
+}
+
+// Two concurrent callers racing to start a download for the same
+// client_id/flow_id/name must not both succeed - the check and the
+// registration have to be atomic under one lock, or both can observe
+// "not running" and one clobbers the other's tracker.
+func (self *TestSuite) TestDownloadTrackingResumptionConcurrent() {
+	const attempts = 20
+
+	var wg sync.WaitGroup
+	errs := make([]error, attempts)
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, _, errs[i] = startDownloadTracking(
+				context.Background(), "C.1234", "F.1234", "ConcurrentDup", 100)
+		}(i)
+	}
+	wg.Wait()
+	defer unregisterTracker("C.1234", "F.1234", "ConcurrentDup")
+
+	successes := 0
+	for _, err := range errs {
+		if err == nil {
+			successes++
+		}
+	}
+	assert.Equal(self.T(), 1, successes)
+}
+
+// Cancelling a tracker transitions it to CANCELLED and cancels the
+// context the download pipeline is watching.
+func (self *TestSuite) TestDownloadCancellation() {
+	tracker, cancel_ctx, err := startDownloadTracking(
+		context.Background(), "C.1234", "F.1234", "Cancelled", 100)
+	assert.NoError(self.T(), err)
+	defer unregisterTracker("C.1234", "F.1234", "Cancelled")
+
+	found, pres := getRunningTracker("C.1234", "F.1234", "Cancelled")
+	assert.True(self.T(), pres)
+
+	found.Cancel(self.ConfigObj)
+
+	select {
+	case <-cancel_ctx.Done():
+	default:
+		self.T().Fatal("Expected the download context to be cancelled")
+	}
+
+	assert.Equal(self.T(), DownloadStateCancelled, tracker.progress.State)
+}
+
+// On success the final progress record must show
+// BytesProcessed == TotalBytes.
+func (self *TestSuite) TestDownloadProgressCompletion() {
+	tracker, _, err := startDownloadTracking(
+		context.Background(), "C.1234", "F.1234", "Complete", 100)
+	assert.NoError(self.T(), err)
+	defer unregisterTracker("C.1234", "F.1234", "Complete")
+
+	tracker.Update(self.ConfigObj, 40, "uploads/uploads/data/file.txt")
+	tracker.Finish(self.ConfigObj)
+
+	assert.Equal(self.T(), DownloadStateDone, tracker.progress.State)
+	assert.Equal(self.T(), tracker.progress.TotalBytes, tracker.progress.BytesProcessed)
+}
+
+// Writes upload files directly into the filestore (bypassing the
+// collector/importer) so CreateFlowDownload's real pipeline - not just
+// the standalone tracker - can be exercised against files this test
+// controls, including cancellation mid-stream.
+func writeUploadFile(self *TestSuite, client_id, flow_id, rel_path, content string) {
+	file_store_factory := file_store.GetFileStore(self.ConfigObj)
+	path_spec := uploadsRootPathSpec(client_id, flow_id).AddUnsafeChild(rel_path)
+
+	writer, err := file_store_factory.WriteFile(path_spec)
+	assert.NoError(self.T(), err)
+	defer writer.Close()
+
+	err = writer.Truncate()
+	assert.NoError(self.T(), err)
+
+	_, err = writer.Write([]byte(content))
+	assert.NoError(self.T(), err)
+}
+
+// CreateFlowDownload must thread the caller's context through to the
+// real zip building pipeline: cancelling the download mid-stream must
+// stop the zip encoder and remove the partial zip rather than leaving
+// a truncated file behind.
+func (self *TestSuite) TestCreateFlowDownloadCancellationRemovesPartialZip() {
+	client_id, flow_id := "C.5678", "F.5678"
+
+	// Enough files that the walk has not finished by the time we
+	// cancel it below.
+	for i := 0; i < 20; i++ {
+		writeUploadFile(self, client_id, flow_id,
+			fmt.Sprintf("data/file%d.txt", i), "0123456789")
+	}
+
+	ctx := context.Background()
+	path_spec := downloadPathSpec(client_id, flow_id, "CancelMe")
+
+	done := make(chan bool)
+	go func() {
+		(&CreateFlowDownload{}).Call(ctx, self.makeScope(),
+			ordereddict.NewDict().
+				Set("client_id", client_id).
+				Set("flow_id", flow_id).
+				Set("wait", true).
+				Set("name", "CancelMe"))
+		close(done)
+	}()
+
+	// Give the pipeline a moment to start, then cancel it.
+	time.Sleep(10 * time.Millisecond)
+	tracker, pres := getRunningTracker(client_id, flow_id, "CancelMe")
+	if pres {
+		tracker.Cancel(self.ConfigObj)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		self.T().Fatal("CreateFlowDownload did not return after cancellation")
+	}
+
+	// The partial zip must not be left behind.
+	file_store_factory := file_store.GetFileStore(self.ConfigObj)
+	_, err := file_store_factory.ReadFile(path_spec)
+	assert.Error(self.T(), err)
+}
+
+// On a normal, non-cancelled run against real uploaded files,
+// CreateFlowDownload must report final progress == total bytes
+// processed, whether or not expand_sparse was requested.
+func (self *TestSuite) TestCreateFlowDownloadRealProgressCompletion() {
+	client_id, flow_id := "C.9012", "F.9012"
+	writeUploadFile(self, client_id, flow_id, "data/a.txt", "hello world")
+	writeUploadFile(self, client_id, flow_id, "data/b.txt", "goodbye world")
+
+	ctx := context.Background()
+	result := (&CreateFlowDownload{}).Call(ctx, self.makeScope(),
+		ordereddict.NewDict().
+			Set("client_id", client_id).
+			Set("flow_id", flow_id).
+			Set("wait", true).
+			Set("expand_sparse", false).
+			Set("name", "Progress"))
+
+	path_spec, ok := result.(path_specs.FSPathSpec)
+	assert.True(self.T(), ok)
+
+	file_details, err := openZipFile(self.ConfigObj, self.makeScope(), path_spec)
+	assert.NoError(self.T(), err)
+
+	content, _ := file_details.GetString("uploads/uploads/data/a.txt")
+	assert.Equal(self.T(), "hello world", content)
+
+	// The tracker is unregistered once the download finishes.
+	_, pres := getRunningTracker(client_id, flow_id, "Progress")
+	assert.False(self.T(), pres)
+}
+
+func (self *TestSuite) makeScope() vfilter.Scope {
+	manager, _ := services.GetRepositoryManager(self.ConfigObj)
+	builder := services.ScopeBuilder{
+		Config:     self.ConfigObj,
+		ACLManager: acl_managers.NullACLManager{},
+		Logger:     logging.NewPlainLogger(self.ConfigObj, &logging.FrontendComponent),
+		Env:        ordereddict.NewDict(),
+	}
+	return manager.BuildScope(builder)
+}
+
 func TestCollectorPlugin(t *testing.T) {
 	suite.Run(t, &TestSuite{})
 }
@@ -0,0 +1,359 @@
+package downloads
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Velocidex/ordereddict"
+	"www.velocidex.com/golang/velociraptor/acls"
+	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
+	"www.velocidex.com/golang/velociraptor/datastore"
+	"www.velocidex.com/golang/velociraptor/file_store/path_specs"
+	vql_subsystem "www.velocidex.com/golang/velociraptor/vql"
+	"www.velocidex.com/golang/vfilter"
+	"www.velocidex.com/golang/vfilter/arg_parser"
+)
+
+type DownloadState string
+
+const (
+	DownloadStatePending   DownloadState = "PENDING"
+	DownloadStateRunning   DownloadState = "RUNNING"
+	DownloadStateDone      DownloadState = "DONE"
+	DownloadStateCancelled DownloadState = "CANCELLED"
+	DownloadStateError     DownloadState = "ERROR"
+)
+
+// DownloadProgress is periodically written into the datastore, next to
+// the download itself, so the GUI (or download_status()) can render a
+// live progress bar without inspecting the partially written zip file.
+type DownloadProgress struct {
+	ClientId       string        `json:"client_id"`
+	FlowId         string        `json:"flow_id"`
+	Name           string        `json:"name"`
+	State          DownloadState `json:"state"`
+	BytesProcessed uint64        `json:"bytes_processed"`
+	TotalBytes     uint64        `json:"total_bytes"`
+	CurrentFile    string        `json:"current_file"`
+	ETA            int64         `json:"eta"`
+	ThroughputBps  uint64        `json:"throughput_bps"`
+	StartTime      int64         `json:"start_time"`
+	LastUpdate     int64         `json:"last_update"`
+	Error          string        `json:"error,omitempty"`
+}
+
+// progressPathSpec returns where the DownloadProgress record for a
+// given download is kept - alongside the zip file itself, so it is
+// cleaned up along with it.
+func progressPathSpec(client_id, flow_id, name string) path_specs.DSPathSpec {
+	return path_specs.NewSafeDatastorePath("downloads", client_id, flow_id, name+"_progress")
+}
+
+// progressUpdateInterval bounds how often a progressTracker flushes to
+// the datastore - the zip encoder calls Update() far more often than
+// this as it consumes each upload.
+const progressUpdateInterval = 2 * time.Second
+
+// progressTracker is handed to the zip building pipeline by
+// CreateFlowDownload so it can report progress and learn about
+// cancellation without depending on the VQL layer directly.
+type progressTracker struct {
+	mu sync.Mutex
+
+	client_id, flow_id, name string
+	clock                    func() time.Time
+
+	last_flush time.Time
+	progress   *DownloadProgress
+
+	cancel_ctx  context.Context
+	cancel_func context.CancelFunc
+}
+
+func newProgressTracker(
+	ctx context.Context, client_id, flow_id, name string,
+	total_bytes uint64) (*progressTracker, context.Context) {
+
+	cancel_ctx, cancel_func := context.WithCancel(ctx)
+
+	self := &progressTracker{
+		client_id:   client_id,
+		flow_id:     flow_id,
+		name:        name,
+		clock:       Clock.Now,
+		cancel_ctx:  cancel_ctx,
+		cancel_func: cancel_func,
+		progress: &DownloadProgress{
+			ClientId:   client_id,
+			FlowId:     flow_id,
+			Name:       name,
+			State:      DownloadStatePending,
+			TotalBytes: total_bytes,
+			StartTime:  Clock.Now().Unix(),
+		},
+	}
+
+	return self, cancel_ctx
+}
+
+// Update records that bytes_processed additional bytes have been
+// written for current_file, and flushes to the datastore at most once
+// per progressUpdateInterval.
+func (self *progressTracker) Update(
+	config_obj *config_proto.Config, bytes_processed uint64, current_file string) {
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.progress.State = DownloadStateRunning
+	self.progress.BytesProcessed += bytes_processed
+	self.progress.CurrentFile = current_file
+
+	now := self.clock()
+	elapsed := now.Unix() - self.progress.StartTime
+	if elapsed > 0 {
+		self.progress.ThroughputBps = self.progress.BytesProcessed / uint64(elapsed)
+	}
+	if self.progress.ThroughputBps > 0 && self.progress.TotalBytes > self.progress.BytesProcessed {
+		remaining := self.progress.TotalBytes - self.progress.BytesProcessed
+		self.progress.ETA = int64(remaining / self.progress.ThroughputBps)
+	}
+	self.progress.LastUpdate = now.Unix()
+
+	if now.Sub(self.last_flush) < progressUpdateInterval {
+		return
+	}
+	self.last_flush = now
+	self.flush(config_obj)
+}
+
+// Finish marks the download as complete, ensuring the final record
+// shows progress == total, and flushes unconditionally.
+func (self *progressTracker) Finish(config_obj *config_proto.Config) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.progress.State = DownloadStateDone
+	self.progress.BytesProcessed = self.progress.TotalBytes
+	self.progress.LastUpdate = self.clock().Unix()
+	self.flush(config_obj)
+}
+
+// Fail marks the download as errored out and flushes unconditionally.
+func (self *progressTracker) Fail(config_obj *config_proto.Config, err error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.progress.State = DownloadStateError
+	self.progress.Error = err.Error()
+	self.progress.LastUpdate = self.clock().Unix()
+	self.flush(config_obj)
+}
+
+// Cancel asks the in-progress download to stop. The caller is
+// responsible for removing the partial zip once the pipeline observes
+// ctx.Done() and returns.
+func (self *progressTracker) Cancel(config_obj *config_proto.Config) {
+	self.mu.Lock()
+	self.progress.State = DownloadStateCancelled
+	self.progress.LastUpdate = self.clock().Unix()
+	self.flush(config_obj)
+	self.mu.Unlock()
+
+	self.cancel_func()
+}
+
+// flush must be called with mu held.
+func (self *progressTracker) flush(config_obj *config_proto.Config) {
+	db, err := datastore.GetDB(config_obj)
+	if err != nil {
+		return
+	}
+
+	_ = db.SetSubjectWithCompletion(config_obj,
+		progressPathSpec(self.client_id, self.flow_id, self.name),
+		self.progress, nil)
+}
+
+type DownloadStatusArgs struct {
+	ClientId string `vfilter:"required,field=client_id"`
+	FlowId   string `vfilter:"required,field=flow_id"`
+	Name     string `vfilter:"required,field=name"`
+}
+
+// DownloadStatusFunction lets the GUI poll the progress of a download
+// that was started with wait=false, to render a progress bar.
+type DownloadStatusFunction struct{}
+
+func (self DownloadStatusFunction) Call(
+	ctx context.Context,
+	scope vfilter.Scope, args *ordereddict.Dict) vfilter.Any {
+
+	err := vql_subsystem.CheckAccess(scope, acls.READ_RESULTS)
+	if err != nil {
+		scope.Log("download_status: %v", err)
+		return vfilter.Null{}
+	}
+
+	arg := &DownloadStatusArgs{}
+	err = arg_parser.ExtractArgsWithContext(ctx, scope, args, arg)
+	if err != nil {
+		scope.Log("download_status: %v", err)
+		return vfilter.Null{}
+	}
+
+	config_obj, ok := vql_subsystem.GetServerConfig(scope)
+	if !ok {
+		scope.Log("download_status: Command can only run on the server")
+		return vfilter.Null{}
+	}
+
+	db, err := datastore.GetDB(config_obj)
+	if err != nil {
+		scope.Log("download_status: %v", err)
+		return vfilter.Null{}
+	}
+
+	progress := &DownloadProgress{}
+	err = db.GetSubject(config_obj,
+		progressPathSpec(arg.ClientId, arg.FlowId, arg.Name), progress)
+	if err != nil {
+		scope.Log("download_status: %v", err)
+		return vfilter.Null{}
+	}
+
+	return progress
+}
+
+func (self DownloadStatusFunction) Info(
+	scope vfilter.Scope, type_map *vfilter.TypeMap) *vfilter.FunctionInfo {
+	return &vfilter.FunctionInfo{
+		Name:    "download_status",
+		Doc:     "Check on the progress of a flow download created with wait=false.",
+		ArgType: type_map.AddType(scope, &DownloadStatusArgs{}),
+	}
+}
+
+type CancelDownloadArgs struct {
+	ClientId string `vfilter:"required,field=client_id"`
+	FlowId   string `vfilter:"required,field=flow_id"`
+	Name     string `vfilter:"required,field=name"`
+}
+
+// CancelDownloadFunction cancels an in-progress download. The partial
+// zip is removed atomically by the download pipeline once it observes
+// the cancellation.
+type CancelDownloadFunction struct{}
+
+func (self CancelDownloadFunction) Call(
+	ctx context.Context,
+	scope vfilter.Scope, args *ordereddict.Dict) vfilter.Any {
+
+	err := vql_subsystem.CheckAccess(scope, acls.COLLECT_CLIENT)
+	if err != nil {
+		scope.Log("cancel_download: %v", err)
+		return vfilter.Null{}
+	}
+
+	arg := &CancelDownloadArgs{}
+	err = arg_parser.ExtractArgsWithContext(ctx, scope, args, arg)
+	if err != nil {
+		scope.Log("cancel_download: %v", err)
+		return vfilter.Null{}
+	}
+
+	config_obj, ok := vql_subsystem.GetServerConfig(scope)
+	if !ok {
+		scope.Log("cancel_download: Command can only run on the server")
+		return vfilter.Null{}
+	}
+
+	tracker, pres := getRunningTracker(arg.ClientId, arg.FlowId, arg.Name)
+	if !pres {
+		scope.Log("cancel_download: no running download for %v/%v/%v",
+			arg.ClientId, arg.FlowId, arg.Name)
+		return false
+	}
+
+	tracker.Cancel(config_obj)
+
+	return true
+}
+
+func (self CancelDownloadFunction) Info(
+	scope vfilter.Scope, type_map *vfilter.TypeMap) *vfilter.FunctionInfo {
+	return &vfilter.FunctionInfo{
+		Name:    "cancel_download",
+		Doc:     "Cancel an in progress flow download.",
+		ArgType: type_map.AddType(scope, &CancelDownloadArgs{}),
+	}
+}
+
+// runningTrackers tracks in-flight downloads so cancel_download() can
+// find the tracker for a download started by a different VQL query
+// (e.g. one kicked off with wait=false from the GUI).
+var (
+	runningTrackersMu sync.Mutex
+	runningTrackers   = make(map[string]*progressTracker)
+)
+
+func trackerKey(client_id, flow_id, name string) string {
+	return client_id + "/" + flow_id + "/" + name
+}
+
+func unregisterTracker(client_id, flow_id, name string) {
+	runningTrackersMu.Lock()
+	defer runningTrackersMu.Unlock()
+	delete(runningTrackers, trackerKey(client_id, flow_id, name))
+}
+
+func getRunningTracker(client_id, flow_id, name string) (*progressTracker, bool) {
+	runningTrackersMu.Lock()
+	defer runningTrackersMu.Unlock()
+	tracker, pres := runningTrackers[trackerKey(client_id, flow_id, name)]
+	return tracker, pres
+}
+
+// startDownloadTracking is called by CreateFlowDownload before it
+// begins zipping. It refuses to start a second tracker for the same
+// client_id/flow_id/name while one is already running, and registers
+// the new tracker so cancel_download() and download_status() can find
+// it. Callers must defer unregisterTracker() once the pipeline exits.
+//
+// The already-running check and the registration happen under the
+// same lock acquisition, so two concurrent downloads for the same
+// client_id/flow_id/name cannot both observe "not running" and both
+// register - one would otherwise silently clobber the other's
+// tracker in runningTrackers.
+func startDownloadTracking(ctx context.Context,
+	client_id, flow_id, name string, total_bytes uint64) (
+	*progressTracker, context.Context, error) {
+
+	key := trackerKey(client_id, flow_id, name)
+
+	runningTrackersMu.Lock()
+	defer runningTrackersMu.Unlock()
+
+	if _, pres := runningTrackers[key]; pres {
+		return nil, nil, errDownloadAlreadyRunning
+	}
+
+	tracker, cancel_ctx := newProgressTracker(ctx, client_id, flow_id, name, total_bytes)
+	runningTrackers[key] = tracker
+
+	return tracker, cancel_ctx, nil
+}
+
+var errDownloadAlreadyRunning = downloadAlreadyRunningError{}
+
+type downloadAlreadyRunningError struct{}
+
+func (downloadAlreadyRunningError) Error() string {
+	return "A download with this client_id/flow_id/name is already running"
+}
+
+func init() {
+	vql_subsystem.RegisterFunction(&DownloadStatusFunction{})
+	vql_subsystem.RegisterFunction(&CancelDownloadFunction{})
+}
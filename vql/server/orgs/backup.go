@@ -0,0 +1,107 @@
+package orgs
+
+import (
+	"context"
+
+	"github.com/Velocidex/ordereddict"
+	"www.velocidex.com/golang/velociraptor/acls"
+	"www.velocidex.com/golang/velociraptor/services"
+	vql_subsystem "www.velocidex.com/golang/velociraptor/vql"
+	"www.velocidex.com/golang/vfilter"
+	"www.velocidex.com/golang/vfilter/arg_parser"
+)
+
+type BackupOrgsArgs struct {
+	OrgId string `vfilter:"optional,field=org_id,doc=Only back up this org (default: all orgs)"`
+}
+
+// backupCapableOrgManager is satisfied by *orgs.OrgManager - BackupOrg
+// is not part of the services.OrgManager interface, so it is reached
+// through this narrower local interface instead.
+type backupCapableOrgManager interface {
+	BackupOrg(ctx context.Context, org_id string) error
+}
+
+// federatedOrgChecker is satisfied by *orgs.OrgManager - IsFederatedOrg
+// is not part of the services.OrgManager interface either. A federated
+// org has no local datastore to back up, so the default "back up every
+// org" pass must not include them - see the note on OrgManager.BackupOrg.
+type federatedOrgChecker interface {
+	IsFederatedOrg(org_id string) bool
+}
+
+// BackupOrgsFunction lets an operator trigger an out of band backup
+// without waiting for the BackupManager's schedule, e.g. right before
+// a maintenance window.
+type BackupOrgsFunction struct{}
+
+func (self BackupOrgsFunction) Call(
+	ctx context.Context,
+	scope vfilter.Scope, args *ordereddict.Dict) vfilter.Any {
+
+	err := vql_subsystem.CheckAccess(scope, acls.SERVER_ADMIN)
+	if err != nil {
+		scope.Log("backup_orgs: %v", err)
+		return vfilter.Null{}
+	}
+
+	arg := &BackupOrgsArgs{}
+	err = arg_parser.ExtractArgsWithContext(ctx, scope, args, arg)
+	if err != nil {
+		scope.Log("backup_orgs: %v", err)
+		return vfilter.Null{}
+	}
+
+	_, ok := vql_subsystem.GetServerConfig(scope)
+	if !ok {
+		scope.Log("backup_orgs: Command can only run on the server")
+		return vfilter.Null{}
+	}
+
+	org_manager, err := services.GetOrgManager()
+	if err != nil {
+		scope.Log("backup_orgs: %v", err)
+		return vfilter.Null{}
+	}
+
+	backup_org_manager, ok := org_manager.(backupCapableOrgManager)
+	if !ok {
+		scope.Log("backup_orgs: backups are not supported by this org manager")
+		return vfilter.Null{}
+	}
+
+	org_ids := []string{}
+	if arg.OrgId != "" {
+		org_ids = append(org_ids, arg.OrgId)
+	} else {
+		fed_checker, _ := org_manager.(federatedOrgChecker)
+		for _, org := range org_manager.ListOrgs() {
+			if fed_checker != nil && fed_checker.IsFederatedOrg(org.OrgId) {
+				continue
+			}
+			org_ids = append(org_ids, org.OrgId)
+		}
+	}
+
+	for _, org_id := range org_ids {
+		err := backup_org_manager.BackupOrg(ctx, org_id)
+		if err != nil {
+			scope.Log("backup_orgs: org %v: %v", org_id, err)
+		}
+	}
+
+	return org_ids
+}
+
+func (self BackupOrgsFunction) Info(
+	scope vfilter.Scope, type_map *vfilter.TypeMap) *vfilter.FunctionInfo {
+	return &vfilter.FunctionInfo{
+		Name:    "backup_orgs",
+		Doc:     "Manually trigger a backup of one or all orgs, outside the normal schedule.",
+		ArgType: type_map.AddType(scope, &BackupOrgsArgs{}),
+	}
+}
+
+func init() {
+	vql_subsystem.RegisterFunction(&BackupOrgsFunction{})
+}
@@ -0,0 +1,232 @@
+package orgs
+
+import (
+	"context"
+	"time"
+
+	"github.com/Velocidex/ordereddict"
+	"www.velocidex.com/golang/velociraptor/acls"
+	"www.velocidex.com/golang/velociraptor/services"
+	"www.velocidex.com/golang/velociraptor/services/orgs"
+	vql_subsystem "www.velocidex.com/golang/velociraptor/vql"
+	"www.velocidex.com/golang/vfilter"
+	"www.velocidex.com/golang/vfilter/arg_parser"
+)
+
+// federationCapableOrgManager is satisfied by *orgs.OrgManager -
+// RegisterFederatedOrg, RegisterInboundFederationSecret and
+// MintFederationToken are not part of the services.OrgManager
+// interface, so they are reached through this narrower local interface
+// and a type assertion instead.
+type federationCapableOrgManager interface {
+	RegisterFederatedOrg(record *orgs.FederatedOrg) error
+	RegisterInboundFederationSecret(org_id, shared_token string)
+	MintFederationToken(remote_org_id, principal string, ttl time.Duration, scopes []string) (string, error)
+}
+
+type RegisterFederatedOrgArgs struct {
+	OrgId             string   `vfilter:"required,field=org_id,doc=The peer deployment's org id to register"`
+	Name              string   `vfilter:"required,field=name"`
+	RemoteFrontendUrl string   `vfilter:"required,field=remote_frontend_url"`
+	Token             string   `vfilter:"required,field=token,doc=Shared secret - the peer must register the same value as an inbound secret for this org id"`
+	Allowlist         []string `vfilter:"optional,field=allowlist,doc=Methods this relationship may proxy (default: none)"`
+}
+
+// RegisterFederatedOrgFunction lets an operator wire up a peer
+// Velociraptor deployment's org as a federated org, so it shows up in
+// ListOrgs and LaunchFlow/ScheduleHunt/ReadVFS calls against it are
+// proxied to the peer over the federation RPC.
+type RegisterFederatedOrgFunction struct{}
+
+func (self RegisterFederatedOrgFunction) Call(
+	ctx context.Context,
+	scope vfilter.Scope, args *ordereddict.Dict) vfilter.Any {
+
+	err := vql_subsystem.CheckAccess(scope, acls.SERVER_ADMIN)
+	if err != nil {
+		scope.Log("register_federated_org: %v", err)
+		return vfilter.Null{}
+	}
+
+	arg := &RegisterFederatedOrgArgs{}
+	err = arg_parser.ExtractArgsWithContext(ctx, scope, args, arg)
+	if err != nil {
+		scope.Log("register_federated_org: %v", err)
+		return vfilter.Null{}
+	}
+
+	_, ok := vql_subsystem.GetServerConfig(scope)
+	if !ok {
+		scope.Log("register_federated_org: Command can only run on the server")
+		return vfilter.Null{}
+	}
+
+	org_manager, err := services.GetOrgManager()
+	if err != nil {
+		scope.Log("register_federated_org: %v", err)
+		return vfilter.Null{}
+	}
+
+	federation_org_manager, ok := org_manager.(federationCapableOrgManager)
+	if !ok {
+		scope.Log("register_federated_org: federation is not supported by this org manager")
+		return vfilter.Null{}
+	}
+
+	err = federation_org_manager.RegisterFederatedOrg(&orgs.FederatedOrg{
+		OrgId:             arg.OrgId,
+		Name:              arg.Name,
+		RemoteFrontendUrl: arg.RemoteFrontendUrl,
+		Token:             arg.Token,
+		Allowlist:         arg.Allowlist,
+	})
+	if err != nil {
+		scope.Log("register_federated_org: %v", err)
+		return vfilter.Null{}
+	}
+
+	return arg.OrgId
+}
+
+func (self RegisterFederatedOrgFunction) Info(
+	scope vfilter.Scope, type_map *vfilter.TypeMap) *vfilter.FunctionInfo {
+	return &vfilter.FunctionInfo{
+		Name:    "register_federated_org",
+		Doc:     "Register a peer Velociraptor deployment's org as a federated org, to call out to it.",
+		ArgType: type_map.AddType(scope, &RegisterFederatedOrgArgs{}),
+	}
+}
+
+type RegisterInboundFederationSecretArgs struct {
+	OrgId string `vfilter:"required,field=org_id,doc=The local org to accept federated calls into"`
+	Token string `vfilter:"required,field=token,doc=Shared secret - must match the Token the calling peer registered via register_federated_org"`
+}
+
+// RegisterInboundFederationSecretFunction authorizes a peer deployment
+// to call into one of this deployment's own orgs - the other half of
+// setting up a federation relationship alongside register_federated_org.
+type RegisterInboundFederationSecretFunction struct{}
+
+func (self RegisterInboundFederationSecretFunction) Call(
+	ctx context.Context,
+	scope vfilter.Scope, args *ordereddict.Dict) vfilter.Any {
+
+	err := vql_subsystem.CheckAccess(scope, acls.SERVER_ADMIN)
+	if err != nil {
+		scope.Log("register_inbound_federation_secret: %v", err)
+		return vfilter.Null{}
+	}
+
+	arg := &RegisterInboundFederationSecretArgs{}
+	err = arg_parser.ExtractArgsWithContext(ctx, scope, args, arg)
+	if err != nil {
+		scope.Log("register_inbound_federation_secret: %v", err)
+		return vfilter.Null{}
+	}
+
+	_, ok := vql_subsystem.GetServerConfig(scope)
+	if !ok {
+		scope.Log("register_inbound_federation_secret: Command can only run on the server")
+		return vfilter.Null{}
+	}
+
+	org_manager, err := services.GetOrgManager()
+	if err != nil {
+		scope.Log("register_inbound_federation_secret: %v", err)
+		return vfilter.Null{}
+	}
+
+	federation_org_manager, ok := org_manager.(federationCapableOrgManager)
+	if !ok {
+		scope.Log("register_inbound_federation_secret: federation is not supported by this org manager")
+		return vfilter.Null{}
+	}
+
+	federation_org_manager.RegisterInboundFederationSecret(arg.OrgId, arg.Token)
+
+	return arg.OrgId
+}
+
+func (self RegisterInboundFederationSecretFunction) Info(
+	scope vfilter.Scope, type_map *vfilter.TypeMap) *vfilter.FunctionInfo {
+	return &vfilter.FunctionInfo{
+		Name:    "register_inbound_federation_secret",
+		Doc:     "Authorize a peer Velociraptor deployment to call into a local org over federation.",
+		ArgType: type_map.AddType(scope, &RegisterInboundFederationSecretArgs{}),
+	}
+}
+
+type MintFederationTokenArgs struct {
+	RemoteOrgId string   `vfilter:"required,field=remote_org_id"`
+	Principal   string   `vfilter:"required,field=principal"`
+	TtlSeconds  int64    `vfilter:"optional,field=ttl,doc=Token lifetime in seconds (default: 1 hour)"`
+	Scopes      []string `vfilter:"optional,field=scopes"`
+}
+
+// MintFederationTokenFunction mints a signed, time limited token that
+// lets principal act against remote_org_id on the peer deployment -
+// this is what an operator hands to an automated process that needs to
+// call into a federated org outside of the normal GUI login flow.
+type MintFederationTokenFunction struct{}
+
+func (self MintFederationTokenFunction) Call(
+	ctx context.Context,
+	scope vfilter.Scope, args *ordereddict.Dict) vfilter.Any {
+
+	err := vql_subsystem.CheckAccess(scope, acls.SERVER_ADMIN)
+	if err != nil {
+		scope.Log("mint_federation_token: %v", err)
+		return vfilter.Null{}
+	}
+
+	arg := &MintFederationTokenArgs{}
+	err = arg_parser.ExtractArgsWithContext(ctx, scope, args, arg)
+	if err != nil {
+		scope.Log("mint_federation_token: %v", err)
+		return vfilter.Null{}
+	}
+
+	_, ok := vql_subsystem.GetServerConfig(scope)
+	if !ok {
+		scope.Log("mint_federation_token: Command can only run on the server")
+		return vfilter.Null{}
+	}
+
+	org_manager, err := services.GetOrgManager()
+	if err != nil {
+		scope.Log("mint_federation_token: %v", err)
+		return vfilter.Null{}
+	}
+
+	federation_org_manager, ok := org_manager.(federationCapableOrgManager)
+	if !ok {
+		scope.Log("mint_federation_token: federation is not supported by this org manager")
+		return vfilter.Null{}
+	}
+
+	ttl := time.Duration(arg.TtlSeconds) * time.Second
+
+	token, err := federation_org_manager.MintFederationToken(
+		arg.RemoteOrgId, arg.Principal, ttl, arg.Scopes)
+	if err != nil {
+		scope.Log("mint_federation_token: %v", err)
+		return vfilter.Null{}
+	}
+
+	return token
+}
+
+func (self MintFederationTokenFunction) Info(
+	scope vfilter.Scope, type_map *vfilter.TypeMap) *vfilter.FunctionInfo {
+	return &vfilter.FunctionInfo{
+		Name:    "mint_federation_token",
+		Doc:     "Mint a signed token for a principal to act against a federated org.",
+		ArgType: type_map.AddType(scope, &MintFederationTokenArgs{}),
+	}
+}
+
+func init() {
+	vql_subsystem.RegisterFunction(&RegisterFederatedOrgFunction{})
+	vql_subsystem.RegisterFunction(&RegisterInboundFederationSecretFunction{})
+	vql_subsystem.RegisterFunction(&MintFederationTokenFunction{})
+}